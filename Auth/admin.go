@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
+)
+
+const defaultPageSize = 20
+const maxPageSize = 100
+
+// Lets the shared middleware check service tokens issued by Auth itself.
+type serviceVerifier struct{}
+
+func (serviceVerifier) Verify(raw string) (*Claims, error) {
+	return verifyServiceToken(raw)
+}
+
+var requireRevocationsRead = authclient.RequireScope(serviceVerifier{}, authclient.BearerToken, "auth:revocations")
+
+// Refuses sign-in for suspended accounts and accounts that must reset their password.
+// Returns false if a response has been written.
+func checkAccountStanding(w http.ResponseWriter, r *http.Request, user User) bool {
+	if user.Suspended {
+		log.Printf("Sign-in of suspended user %s refused.", user.Username)
+		recordAudit(r, auditLoginFailed, user.Username, map[string]string{"reason": "suspended"})
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("{\"error\": \"Account is suspended\"}"))
+		return false
+	}
+
+	if user.PasswordResetRequired {
+		log.Printf("Sign-in of user %s refused until their password is reset.", user.Username)
+		recordAudit(r, auditLoginFailed, user.Username, map[string]string{"reason": "password_reset_required"})
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("{\"error\": \"Password reset required\"}"))
+		return false
+	}
+
+	return true
+}
+
+// Parses a non-negative integer query parameter, or returns fallback if it is missing or invalid.
+func queryInt(r *http.Request, key string, fallback int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(key))
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+// Requires authentication as an admin. Lists accounts ordered by username, a page at a time.
+// "q" matches part of the username or display name, and "role" only lists users with that role.
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	role := r.URL.Query().Get("role")
+	offset := queryInt(r, "offset", 0)
+	limit := queryInt(r, "limit", defaultPageSize)
+	if limit == 0 || limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	all, err := accounts.List()
+
+	if err != nil {
+		log.Printf("Error: Could not list accounts : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not list users\"}"))
+		return
+	}
+
+	matches := []User{}
+	for _, user := range all {
+		if query != "" && !strings.Contains(user.Username, query) && !strings.Contains(strings.ToLower(user.Name), query) {
+			continue
+		}
+		if role != "" && !hasRole(user, role) {
+			continue
+		}
+		matches = append(matches, user)
+	}
+
+	page := []User{}
+	if offset < len(matches) {
+		end := offset + limit
+		if end > len(matches) {
+			end = len(matches)
+		}
+		page = matches[offset:end]
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Users  []User `json:"users"`
+		Total  int    `json:"total"`
+		Offset int    `json:"offset"`
+		Limit  int    `json:"limit"`
+	}{page, len(matches), offset, limit})
+}
+
+func hasRole(user User, role string) bool {
+	for _, r := range user.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Looks up the user named in the path for an admin action. Admins cannot act on their own account,
+// so that they cannot lock themselves out. Returns false if a response has been written.
+func targetUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	username := mux.Vars(r)["username"]
+	admin, _ := authclient.ClaimsFromContext(r.Context())
+
+	if username == admin.Username {
+		log.Printf("Error: Admin %s tried %s %s on their own account", admin.Username, r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Admins cannot do this to their own account\"}"))
+		return User{}, false
+	}
+
+	user, err := accounts.Get(username)
+
+	if err != nil {
+		log.Printf("Error: Admin action on unknown user %s", username)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{\"error\": \"User not found\"}"))
+		return User{}, false
+	}
+
+	return user, true
+}
+
+// Requires authentication as an admin. Stops the user signing in and rejects their tokens at once.
+func suspendUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	suspended, err := revokeSessions(user.Username, func(user *User) {
+		user.Suspended = true
+	})
+
+	if err != nil {
+		log.Printf("Error: Could not suspend user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not suspend user\"}"))
+		return
+	}
+
+	admin, _ := authclient.ClaimsFromContext(r.Context())
+	log.Printf("User %s suspended by %s", user.Username, admin.Username)
+	recordAudit(r, auditUserSuspended, user.Username, nil)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(suspended)
+}
+
+// Requires authentication as an admin. Lets a suspended user sign in again. Tokens revoked on suspension stay revoked.
+func reactivateUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	reactivated, err := accounts.Update(user.Username, func(user *User) error {
+		user.Suspended = false
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("Error: Could not reactivate user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not reactivate user\"}"))
+		return
+	}
+
+	admin, _ := authclient.ClaimsFromContext(r.Context())
+	log.Printf("User %s reactivated by %s", user.Username, admin.Username)
+	recordAudit(r, auditUserReactivated, user.Username, nil)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reactivated)
+}
+
+// Requires authentication as an admin. Signs the user out everywhere and sends them a reset token.
+// They cannot sign in again until they have used it.
+func forcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	updated, err := revokeSessions(user.Username, func(user *User) {
+		user.PasswordResetRequired = true
+	})
+
+	if err == nil {
+		err = sendPasswordReset(updated)
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not force password reset for user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not force password reset\"}"))
+		return
+	}
+
+	admin, _ := authclient.ClaimsFromContext(r.Context())
+	log.Printf("Password reset forced for user %s by %s", user.Username, admin.Username)
+	recordAudit(r, auditPasswordResetForced, user.Username, nil)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(updated)
+}
+
+// Requires authentication as an admin. Removes the account and rejects its tokens at once.
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := accounts.Delete(user.Username); err != nil {
+		log.Printf("Error: Could not delete user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not delete user\"}"))
+		return
+	}
+
+	sessions.endUser(user.Username)
+	userRevocations.revoke(user.Username, time.Now())
+
+	admin, _ := authclient.ClaimsFromContext(r.Context())
+	log.Printf("User %s deleted by %s", user.Username, admin.Username)
+	recordAudit(r, auditUserDeleted, user.Username, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
+)
+
+// Types of audit event.
+const (
+	auditUserRegistered      = "user_registered"
+	auditLoginSucceeded      = "login_succeeded"
+	auditLoginFailed         = "login_failed"
+	auditLockout             = "lockout"
+	auditTokenIssued         = "token_issued"
+	auditTokenRefreshed      = "token_refreshed"
+	auditTokenRevoked        = "token_revoked"
+	auditPasswordChanged     = "password_changed"
+	auditPasswordResetForced = "password_reset_forced"
+	auditRoleChanged         = "role_changed"
+	auditTOTPEnabled         = "totp_enabled"
+	auditUserSuspended       = "user_suspended"
+	auditUserReactivated     = "user_reactivated"
+	auditUserDeleted         = "user_deleted"
+)
+
+const defaultAuditQueryLimit = 100
+
+// One line of the audit log. Each event's hash covers the event and the hash of the one before it,
+// so editing or removing a line breaks the chain from that point on.
+type auditEvent struct {
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Username string    `json:"username,omitempty"`
+	// The admin or service that acted on the user, when it was not the user themselves.
+	Actor    string            `json:"actor,omitempty"`
+	IP       string            `json:"ip,omitempty"`
+	Details  map[string]string `json:"details,omitempty"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+// Hash of the event with its own hash left out. Map keys are encoded in sorted order, so this is stable.
+func (e auditEvent) digest() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Appends events to a JSON-lines file. The file is only ever appended to.
+type auditLog struct {
+	mutex    sync.Mutex
+	path     string
+	file     *os.File
+	lastSeq  int64
+	lastHash string
+}
+
+var audit = &auditLog{}
+
+// Opens the log at path, carrying on the chain from its last event.
+func (a *auditLog) open(path string) error {
+	events, intact, err := readAuditLog(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !intact {
+		log.Printf("Error: Audit log %s has been tampered with. New events are chained to its last line.", path)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.path = path
+	a.file = file
+	if len(events) > 0 {
+		last := events[len(events)-1]
+		a.lastSeq, a.lastHash = last.Seq, last.Hash
+	}
+	return nil
+}
+
+// Appends an event. Failures are logged rather than returned, since the action being audited has already happened.
+func (a *auditLog) record(event auditEvent) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	event.Seq = a.lastSeq + 1
+	event.Time = time.Now().UTC()
+	event.PrevHash = a.lastHash
+	event.Hash = event.digest()
+
+	data, err := json.Marshal(event)
+	if err == nil && a.file != nil {
+		_, err = a.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		log.Printf("Error: Could not write %s audit event for user %s : %s", event.Type, event.Username, err)
+		return
+	}
+
+	a.lastSeq, a.lastHash = event.Seq, event.Hash
+}
+
+// Records an event about username caused by request r. If an authenticated caller other than the user
+// made the request, e.g. an admin, they are recorded as the actor.
+func recordAudit(r *http.Request, eventType, username string, details map[string]string) {
+	event := auditEvent{
+		Type:     eventType,
+		Username: username,
+		IP:       clientIP(r),
+		Details:  details,
+	}
+
+	if claims, ok := authclient.ClaimsFromContext(r.Context()); ok && claims.Username != username {
+		event.Actor = claims.Username
+	}
+
+	audit.record(event)
+}
+
+// Reads every event in the file and reports whether the hash chain is intact.
+func readAuditLog(path string) ([]auditEvent, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, true, err
+	}
+	defer file.Close()
+
+	var events []auditEvent
+	intact := true
+	prevHash := ""
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			intact = false
+			continue
+		}
+		if event.PrevHash != prevHash || event.Hash != event.digest() {
+			intact = false
+		}
+		prevHash = event.Hash
+		events = append(events, event)
+	}
+	return events, intact, scanner.Err()
+}
+
+// Requires authentication as an admin. Returns the most recent audit events, newest first.
+// Events can be filtered by "username", "type" (comma separated) and a "since"/"until" time range in RFC 3339.
+func queryAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+
+	var since, until time.Time
+	var err error
+	if value := query.Get("since"); value != "" {
+		since, err = time.Parse(time.RFC3339, value)
+	}
+	if value := query.Get("until"); value != "" && err == nil {
+		until, err = time.Parse(time.RFC3339, value)
+	}
+
+	if err != nil {
+		log.Printf("Error: Invalid audit time range : %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"since and until must be RFC 3339 times\"}"))
+		return
+	}
+
+	types := map[string]bool{}
+	for _, eventType := range strings.Split(query.Get("type"), ",") {
+		if eventType != "" {
+			types[eventType] = true
+		}
+	}
+
+	limit := queryInt(r, "limit", defaultAuditQueryLimit)
+	if limit == 0 {
+		limit = defaultAuditQueryLimit
+	}
+
+	// Hold the lock so that a half-written line is never read
+	audit.mutex.Lock()
+	events, intact, err := readAuditLog(audit.path)
+	audit.mutex.Unlock()
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error: Could not read audit log : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not read audit log\"}"))
+		return
+	}
+
+	matches := []auditEvent{}
+	for i := len(events) - 1; i >= 0 && len(matches) < limit; i-- {
+		event := events[i]
+		if username := query.Get("username"); username != "" && event.Username != username && event.Actor != username {
+			continue
+		}
+		if len(types) > 0 && !types[event.Type] {
+			continue
+		}
+		if (!since.IsZero() && event.Time.Before(since)) || (!until.IsZero() && event.Time.After(until)) {
+			continue
+		}
+		matches = append(matches, event)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Events []auditEvent `json:"events"`
+		// False if any line of the log has been altered or removed.
+		ChainIntact bool `json:"chain_intact"`
+	}{matches, intact})
+}
@@ -2,30 +2,61 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"regexp"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtKey = []byte("secret_jwt_key")
+// Work factor for new password hashes. Set from configuration at start-up.
+var bcryptCost = bcrypt.DefaultCost
+
+// Compared against when signing in as a user that does not exist.
+var unknownUserHash string
+
+// How long access tokens and refresh tokens remain valid. Set from configuration at start-up.
+var accessTokenTTL = 5 * time.Minute
+var refreshTokenTTL = 30 * 24 * time.Hour
 
 type User struct {
 	Username string `json:"username"`
 	Name string `json:"name"`
+	Roles []string `json:"roles"`
 	PasswordHash string `json:"-"`
+	// Tokens issued before this time are rejected, e.g. after a password reset.
+	TokensValidAfter time.Time `json:"-"`
+	// Two-factor authentication. The secret is set on enrolment, but only required at sign-in once confirmed.
+	TOTPEnabled bool `json:"totp_enabled"`
+	TOTPSecret string `json:"-"`
+	TOTPLastStep int64 `json:"-"`
+	RecoveryCodes []string `json:"-"`
+	// Set by an admin. Suspended users cannot sign in and their tokens are rejected.
+	Suspended bool `json:"suspended"`
+	// Set by an admin. The user must choose a new password with a reset token before signing in again.
+	PasswordResetRequired bool `json:"password_reset_required"`
 }
 
-var accounts = map[string] User{}
+var accounts AccountStore
 
-type Claims struct {
-	Username string `json:"username"`
-	Name string `json:"name"`
-	jwt.StandardClaims
-}
+// Usernames are lowercase letters, digits and underscores only.
+var usernamePattern = regexp.MustCompile("^[a-z0-9_]{3,32}$")
+
+const minPasswordLength = 8
+const maxNameLength = 64
+
+var errPasswordChanged = errors.New("password changed since it was checked")
+
+// Claims are shared with the services that verify our tokens.
+type Claims = authclient.Claims
 
 func signIn(w http.ResponseWriter, r *http.Request) {
 	// Get given username and password values from request
@@ -36,81 +67,369 @@ func signIn(w http.ResponseWriter, r *http.Request) {
 
 	username := r.FormValue("username")
 	password := r.FormValue("password")
+	ip := clientIP(r)
+
+	// Refuse to check the password at all while the username or IP is locked out.
+	if wait := loginAttempts.reserve(username, ip); wait > 0 {
+		log.Printf("Sign-in of user %s from %s refused during lockout.", username, ip)
+		recordAudit(r, auditLoginFailed, username, map[string]string{"reason": "locked_out"})
+		writeLockedOut(w, wait)
+		return
+	}
+	defer loginAttempts.release(username, ip)
 
-	// Lookup user in accounts map. Fetch the hashed password
-	user := accounts[username]
+	// Lookup user in account store. Fetch the hashed password.
+	// An unknown user is checked against a dummy hash so that it takes as long to reject as a wrong password.
+	user, err := accounts.Get(username)
 	hashedPassword := user.PasswordHash
+	if err != nil {
+		hashedPassword = unknownUserHash
+	}
 
 	// If the password does not match the hash, return 401.
-	if !verifyPassword(hashedPassword, password) {
+	if !verifyPassword(hashedPassword, password) || err != nil {
 		log.Printf("Sign-in of user %s failed.", username)
+		reason := "incorrect_password"
+		if err != nil {
+			reason = "unknown_user"
+		}
+		recordAudit(r, auditLoginFailed, username, map[string]string{"reason": reason})
+
+		if loginAttempts.recordFailure(username, ip) {
+			log.Printf("Sign-in locked out for user %s from %s.", username, ip)
+			recordAudit(r, auditLockout, username, nil)
+		}
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("{\"error\": \"Incorrect credentials provided\"}"))
 		return
 	}
 
-	// Calculate an expiration time 5 minutes from now
-	expirationTime := time.Now().Add(5 * time.Minute)
+	rehashIfNeeded(user, password)
 
-	// Create a claims struct that includes the username and expiration time. 
-	claims := &Claims{
-		Username: username,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
+	if !checkAccountStanding(w, r, user) {
+		return
+	}
+
+	// With two-factor enabled, the password only earns a challenge to be completed at /login/totp.
+	if user.TOTPEnabled {
+		challenge, err := totpChallenges.issue(username)
+
+		if err != nil {
+			log.Printf("Error: Could not create TOTP challenge for user %s : %s", username, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("{\"error\": \"Could not create JWT token\"}"))
+			return
+		}
+
+		log.Printf("Password accepted for user %s. Waiting for TOTP code.", username)
+		recordAudit(r, auditLoginSucceeded, username, map[string]string{"totp_required": "true"})
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(struct {
+			TOTPRequired bool `json:"totp_required"`
+			ChallengeToken string `json:"challenge_token"`
+		}{true, challenge})
+		return
 	}
 
-	// Create a token with the HS256 hash method and the claims created above
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	recordAudit(r, auditLoginSucceeded, username, nil)
+
+	// Signing in starts a new session
+	userInfo, err := issueTokens(r, user, "")
 
 	if err != nil {
 		log.Printf("Error: Could not create JWT for user %s : %s", username, err)
 		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not create JWT token\"}"))
+		return
 	}
 
-	userInfo := struct {
-		Token string `json:"token"`
-	}{
-		Token: tokenString,
-	}
+	// Failures are only cleared once the whole sign-in has succeeded, so for two-factor accounts that is
+	// done at /login/totp. Otherwise a correct password would wipe out wrong codes guessed since.
+	loginAttempts.recordSuccess(username)
 
 	// Return JSON with user token encoded
 	json.NewEncoder(w).Encode(userInfo)
 	log.Printf("JWT Token successfully created for user %s.", username )
 }
 
+func register(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+
+	username := r.FormValue("username")
+	name := strings.TrimSpace(r.FormValue("name"))
+	password := r.FormValue("password")
+
+	// Riders can sign up by default. Drivers choose the driver role. Admins can only be made by another admin.
+	role := r.FormValue("role")
+	if role == "" {
+		role = authclient.RoleRider
+	}
+
+	if !usernamePattern.MatchString(username) {
+		log.Printf("Registration rejected: invalid username %q", username)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Username must be 3-32 lowercase letters, digits or underscores\"}"))
+		return
+	}
+
+	if name == "" || len(name) > maxNameLength {
+		log.Printf("Registration rejected for %s: invalid display name", username)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Name must be between 1 and 64 characters\"}"))
+		return
+	}
+
+	if err := validatePassword(username, password); err != nil {
+		log.Printf("Registration rejected for %s: %s", username, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err)))
+		return
+	}
+
+	if role != authclient.RoleRider && role != authclient.RoleDriver {
+		log.Printf("Registration rejected for %s: cannot self-assign role %q", username, role)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Role must be rider or driver\"}"))
+		return
+	}
+
+	hashedPassword, err := hashSaltPassword(password)
+
+	if err != nil {
+		log.Printf("Error: Could not hash password for user %s : %s", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not create account\"}"))
+		return
+	}
+
+	user := User{
+		Username: username,
+		Name: name,
+		Roles: []string{role},
+		PasswordHash: hashedPassword,
+	}
+
+	err = accounts.Create(user)
+
+	if err == ErrAccountExists {
+		log.Printf("Registration rejected: username %s already taken", username)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("{\"error\": \"Username is already taken\"}"))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not store account for user %s : %s", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not create account\"}"))
+		return
+	}
+
+	// A new account is signed in straight away, in a session of its own
+	userInfo, err := issueTokens(r, user, "")
+
+	if err != nil {
+		log.Printf("Error: Could not create JWT for user %s : %s", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not create JWT token\"}"))
+		return
+	}
+
+	log.Printf("User %s registered.", username)
+	recordAudit(r, auditUserRegistered, username, map[string]string{"role": role})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(userInfo)
+}
+
 func validateToken(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	rawToken := vars["token"]
 
-	// Surprisingly hard to find documentation for the function below.
-	// https://github.com/dgrijalva/jwt-go/blob/master/MIGRATION_GUIDE.md
-	token, err := jwt.ParseWithClaims(rawToken, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	_, user, err := verifyToken(rawToken)
 
-	if err != nil || !token.Valid {
+	if err != nil {
 		log.Printf("Invalid or incorrect JWT token received : %s", err)
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("{\"error\": \"Invalid or incorrect JWT token received.\"}"))
 		return
 	}
 
-	claims := token.Claims.(*Claims)
-
-	// Since account deletion is not required in spec, we cannot have a valid JWT for an account that does not exist.
-	// Ok to ignore error value below.
-	user, _ := accounts[claims.Username]
-
 	log.Printf("User %s JWT token successfully validated", user.Username)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(user)
 }
 
+// Checks the signature, expiry and revocation status of a raw JWT.
+func parseToken(rawToken string) (*Claims, error) {
+	// Surprisingly hard to find documentation for the function below.
+	// https://github.com/dgrijalva/jwt-go/blob/master/MIGRATION_GUIDE.md
+	token, err := jwt.ParseWithClaims(rawToken, &Claims{}, signingKeys.verificationKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, errors.New("token is not valid")
+	}
+
+	claims := token.Claims.(*Claims)
+
+	if revokedTokens.isRevoked(claims.Id) {
+		return nil, errors.New("token has been revoked")
+	}
+
+	return claims, nil
+}
+
+// Checks a user's JWT as parseToken does, and looks up the account it was issued to.
+func verifyToken(rawToken string) (*Claims, User, error) {
+	claims, err := parseToken(rawToken)
+
+	if err != nil {
+		return nil, User{}, err
+	}
+
+	// A persistent store may have been replaced since the token was issued, so the account may no longer exist.
+	user, err := accounts.Get(claims.Username)
+
+	if err != nil {
+		return nil, User{}, fmt.Errorf("token issued to unknown user %s : %s", claims.Username, err)
+	}
+
+	// iat only has whole seconds, so a token issued in the same second as the revocation may predate it
+	if claims.IssuedAt <= user.TokensValidAfter.Unix() {
+		return nil, User{}, errors.New("token was issued before the user's sessions were revoked")
+	}
+
+	if user.Suspended {
+		return nil, User{}, errors.New("token issued to suspended user " + user.Username)
+	}
+
+	if claims.SessionID != "" && !sessions.isActive(claims.SessionID) {
+		return nil, User{}, errors.New("token belongs to a session that has ended")
+	}
+
+	return claims, user, nil
+}
+
+// Returns the JWT from an "Authorization: Bearer" header, falling back to a "token" form value.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return r.FormValue("token")
+}
+
+type tokenResponse struct {
+	Token string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// Creates an access token and a refresh token for the given user in the given session.
+// An empty session starts a new one, described by the sign-in request r.
+func issueTokens(r *http.Request, user User, session string) (tokenResponse, error) {
+	var err error
+	eventType := auditTokenRefreshed
+	if session == "" {
+		session, err = sessions.start(user.Username, r)
+		eventType = auditTokenIssued
+	} else {
+		sessions.touch(session, r)
+	}
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	tokenString, err := createToken(user, session)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	// The session's refresh tokens form one family
+	refreshToken, err := refreshTokens.issue(user.Username, session)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	recordAudit(r, eventType, user.Username, map[string]string{"session": session})
+
+	return tokenResponse{
+		Token: tokenString,
+		RefreshToken: refreshToken,
+		ExpiresIn: int64(accessTokenTTL / time.Second),
+	}, nil
+}
+
+// Creates a signed JWT for the given user.
+func createToken(user User, session string) (string, error) {
+	// Calculate an expiration time from now using the configured access token lifetime
+	// Tokens issued in the same second as the user's last revocation are rejected with the revoked ones,
+	// so a new token must wait for the next second.
+	now := time.Now()
+	if now.Unix() <= user.TokensValidAfter.Unix() {
+		time.Sleep(user.TokensValidAfter.Truncate(time.Second).Add(time.Second).Sub(now))
+		now = time.Now()
+	}
+	expirationTime := now.Add(accessTokenTTL)
+
+	// Each token gets a unique ID so that it can be revoked individually.
+	tokenID, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	// Create a claims struct that includes the username and expiration time. 
+	claims := &Claims{
+		Username: user.Username,
+		Name: user.Name,
+		Roles: user.Roles,
+		SessionID: session,
+		StandardClaims: jwt.StandardClaims{
+			Id: tokenID,
+			Subject: user.Username,
+			IssuedAt: now.Unix(),
+			ExpiresAt: expirationTime.Unix(),
+		},
+	}
+
+	// Sign the token with the active RS256 key
+	return signingKeys.sign(claims)
+}
+
+// Rejects passwords that are too short, lack a mix of letters and digits, or match the username.
+func validatePassword(username, password string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("Password must be at least 8 characters long")
+	}
+
+	hasLetter, hasDigit := false, false
+	for _, c := range password {
+		if unicode.IsLetter(c) {
+			hasLetter = true
+		}
+		if unicode.IsDigit(c) {
+			hasDigit = true
+		}
+	}
+
+	if !hasLetter || !hasDigit {
+		return errors.New("Password must contain both letters and digits")
+	}
+
+	if strings.EqualFold(password, username) {
+		return errors.New("Password must not match the username")
+	}
+
+	return nil
+}
+
 func hashSaltPassword(pwd string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.MinCost)
+	hash, err := bcrypt.GenerateFromPassword([]byte(pwd), bcryptCost)
 	// If there is an error, pass it on.
 	if err != nil {
 		return "", err
@@ -122,34 +441,125 @@ func verifyPassword(hash, password string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil;
 }
 
-func initialiseAccounts() {
-	// Controlled case should not have error, safe to ignore here.
-	password1, _ := hashSaltPassword("astonmartin")
-	password2, _ := hashSaltPassword("edgarwright")
-
-	accounts["sebvet"] = User {
-		Username: "sebvet",
-		Name: "Sebastian Vettel",
-		PasswordHash: password1,
+// Re-hashes the password of a user who has just signed in if their hash was made with a different bcrypt cost.
+// Failures are only logged, since the sign-in itself has succeeded.
+func rehashIfNeeded(user User, password string) {
+	cost, err := bcrypt.Cost([]byte(user.PasswordHash))
+	if err != nil || cost == bcryptCost {
+		return
 	}
 
-	accounts["babydriver"] = User {
-		Username: "babydriver",
-		Name: "Ansel Elgort",
-		PasswordHash: password2,
+	hashedPassword, err := hashSaltPassword(password)
+	if err != nil {
+		log.Printf("Error: Could not rehash password for user %s : %s", user.Username, err)
+		return
 	}
 
+	// Only the hash is replaced, and only if the password has not been changed since it was checked
+	_, err = accounts.Update(user.Username, func(current *User) error {
+		if current.PasswordHash != user.PasswordHash {
+			return errPasswordChanged
+		}
+		current.PasswordHash = hashedPassword
+		return nil
+	})
+	if err == errPasswordChanged {
+		return
+	}
+	if err != nil {
+		log.Printf("Error: Could not store rehashed password for user %s : %s", user.Username, err)
+		return
+	}
+	log.Printf("Rehashed password for user %s from cost %d to %d.", user.Username, cost, bcryptCost)
 }
 
 func handleRequests() {
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/login", signIn).Methods("POST")
+	router.HandleFunc("/login/totp", signInTOTP).Methods("POST")
+	router.HandleFunc("/register", register).Methods("POST")
+	router.HandleFunc("/token/refresh", refreshAccessToken).Methods("POST")
+	router.HandleFunc("/logout", logout).Methods("POST")
 	router.HandleFunc("/validate/{token}", validateToken).Methods("GET")
+	router.HandleFunc("/introspect", introspectToken).Methods("POST")
+	router.HandleFunc("/oauth/token", issueServiceToken).Methods("POST")
+	router.HandleFunc("/.well-known/jwks.json", getJWKS).Methods("GET")
+	router.Handle("/revocations", requireRevocationsRead(http.HandlerFunc(getRevocations))).Methods("GET")
+	router.HandleFunc("/sessions", listSessions).Methods("GET")
+	router.HandleFunc("/sessions/{id}", endSession).Methods("DELETE")
+	router.HandleFunc("/password", changePassword).Methods("POST")
+	router.HandleFunc("/password/reset-request", requestPasswordReset).Methods("POST")
+	router.HandleFunc("/password/reset", resetPassword).Methods("POST")
+	router.Handle("/totp/enrol", requireTOTPUser(http.HandlerFunc(enrolTOTP))).Methods("POST")
+	router.Handle("/totp/confirm", requireTOTPUser(http.HandlerFunc(confirmTOTP))).Methods("POST")
+	router.Handle("/audit", requireAdmin(http.HandlerFunc(queryAudit))).Methods("GET")
+	router.Handle("/users", requireAdmin(http.HandlerFunc(listUsers))).Methods("GET")
+	router.Handle("/users/{username}", requireAdmin(http.HandlerFunc(deleteUser))).Methods("DELETE")
+	router.Handle("/users/{username}/suspend", requireAdmin(http.HandlerFunc(suspendUser))).Methods("POST")
+	router.Handle("/users/{username}/reactivate", requireAdmin(http.HandlerFunc(reactivateUser))).Methods("POST")
+	router.Handle("/users/{username}/password-reset", requireAdmin(http.HandlerFunc(forcePasswordReset))).Methods("POST")
+	router.Handle("/users/{username}/roles", requireAdmin(http.HandlerFunc(setRoles))).Methods("PUT")
+	router.Handle("/users/{username}/sessions", requireAdmin(http.HandlerFunc(endUserSessions))).Methods("DELETE")
 	log.Fatal(http.ListenAndServe(":8000", router))
 }
 
 func main() {
 	log.Println("Starting Auth Service")
-	initialiseAccounts()
+
+	var err error
+	if accessTokenTTL, err = getEnvDuration("ACCESS_TOKEN_TTL", accessTokenTTL); err != nil {
+		log.Fatalf("Error: Invalid ACCESS_TOKEN_TTL : %s", err)
+	}
+	if refreshTokenTTL, err = getEnvDuration("REFRESH_TOKEN_TTL", refreshTokenTTL); err != nil {
+		log.Fatalf("Error: Invalid REFRESH_TOKEN_TTL : %s", err)
+	}
+
+	keyGrace, err := getEnvDuration("JWT_KEY_GRACE", time.Hour)
+	if err != nil {
+		log.Fatalf("Error: Invalid JWT_KEY_GRACE : %s", err)
+	}
+	if err := signingKeys.init(getEnv("JWT_KEY_DIR", ""), keyGrace); err != nil {
+		log.Fatalf("Error: Could not load signing keys : %s", err)
+	}
+	go signingKeys.reloadEvery(time.Minute)
+
+	if bcryptCost, err = getEnvInt("BCRYPT_COST", bcryptCost); err != nil || bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+		log.Fatalf("Error: Invalid BCRYPT_COST, must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if unknownUserHash, err = hashSaltPassword("unknown user"); err != nil {
+		log.Fatalf("Error: Could not hash password : %s", err)
+	}
+	go loginAttempts.pruneEvery(10 * time.Minute)
+
+	if outbox := getEnv("PASSWORD_RESET_OUTBOX", ""); outbox != "" {
+		notifier = outboxNotifier{path: outbox}
+	}
+	go passwordResets.pruneEvery(10 * time.Minute)
+	go totpChallenges.pruneEvery(time.Minute)
+
+	go refreshTokens.pruneEvery(time.Hour)
+	go sessions.pruneEvery(time.Hour)
+	go revokedTokens.pruneEvery(time.Minute)
+	go endedSessions.pruneEvery(time.Minute)
+	go userRevocations.pruneEvery(time.Minute)
+
+	if err := audit.open(getEnv("AUDIT_LOG_PATH", "audit.log")); err != nil {
+		log.Fatalf("Error: Could not open audit log : %s", err)
+	}
+
+	store, err := newAccountStore()
+	if err != nil {
+		log.Fatalf("Error: Could not open account store : %s", err)
+	}
+	accounts = store
+
+	if err := seedAccounts(accounts, getEnv("ACCOUNT_FIXTURES", "accounts.json")); err != nil {
+		log.Fatalf("Error: Could not seed accounts from fixtures : %s", err)
+	}
+
+	if err := serviceClients.load(getEnv("CLIENT_FIXTURES", "clients.json")); err != nil {
+		log.Fatalf("Error: Could not load service clients : %s", err)
+	}
+
 	handleRequests()
 }
\ No newline at end of file
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/base32"
+	"encoding/base64"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -13,6 +15,7 @@ import (
 
 type Token struct {
 	Token string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 type driver struct {
@@ -90,3 +93,987 @@ func TestAuth(t *testing.T) {
 	}
 
 }
+
+func TestRegister(t *testing.T) {
+	client := &http.Client{}
+
+	// Usernames must be unique, so suffix with the current time in case the store outlives the test run.
+	username := "newdriver" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	data := url.Values{}
+	data.Set("username", username)
+	data.Set("name", "New Driver")
+	data.Set("password", "n3wdriverpass")
+
+	req, _ := http.NewRequest("POST", "http://auth-service:8000/register", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		log.Println("Failed valid registration unit test.")
+		t.FailNow()
+	}
+
+	var token Token
+	json.NewDecoder(resp.Body).Decode(&token)
+
+	// Token returned on registration should validate straight away
+	r, err := http.Get("http://auth-service:8000/validate/"+token.Token)
+
+	if err != nil || r.StatusCode != http.StatusOK {
+		log.Println("Failed to validate JWT returned on registration")
+		t.Fail()
+	}
+
+	// Registering the same username again should be rejected
+	req, _ = http.NewRequest("POST", "http://auth-service:8000/register", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err = client.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusConflict {
+		log.Println("Failed to reject duplicate registration")
+		t.Fail()
+	}
+
+	// Weak passwords should be rejected
+	data.Set("username", username+"_weak")
+	data.Set("password", "short")
+	req, _ = http.NewRequest("POST", "http://auth-service:8000/register", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err = client.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		log.Println("Failed to reject weak password on registration")
+		t.Fail()
+	}
+}
+
+func refresh(refreshToken string) (*http.Response, error) {
+	data := url.Values{}
+	data.Set("refresh_token", refreshToken)
+	return http.PostForm("http://auth-service:8000/token/refresh", data)
+}
+
+func TestRefreshToken(t *testing.T) {
+	data := url.Values{}
+	data.Set("username", "babydriver")
+	data.Set("password", "edgarwright")
+
+	resp, err := http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to sign in before refresh unit test.")
+		t.FailNow()
+	}
+
+	var original Token
+	json.NewDecoder(resp.Body).Decode(&original)
+
+	if original.RefreshToken == "" {
+		log.Println("Failed to return refresh token on sign-in")
+		t.FailNow()
+	}
+
+	// Exchange the refresh token for a new pair
+	resp, err = refresh(original.RefreshToken)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to refresh token")
+		t.FailNow()
+	}
+
+	var renewed Token
+	json.NewDecoder(resp.Body).Decode(&renewed)
+
+	if renewed.Token == "" || renewed.RefreshToken == "" || renewed.RefreshToken == original.RefreshToken {
+		log.Println("Failed to rotate refresh token")
+		t.Fail()
+	}
+
+	// Replaying the original refresh token should be rejected...
+	resp, err = refresh(original.RefreshToken)
+
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to reject reused refresh token")
+		t.Fail()
+	}
+
+	// ...and should revoke the rest of the family
+	resp, err = refresh(renewed.RefreshToken)
+
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to revoke token family after refresh token reuse")
+		t.Fail()
+	}
+}
+
+func TestLogout(t *testing.T) {
+	data := url.Values{}
+	data.Set("username", "sebvet")
+	data.Set("password", "astonmartin")
+
+	resp, err := http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to sign in before logout unit test.")
+		t.FailNow()
+	}
+
+	var token Token
+	json.NewDecoder(resp.Body).Decode(&token)
+
+	// Log out, revoking both the access token and the refresh token
+	data = url.Values{}
+	data.Set("refresh_token", token.RefreshToken)
+	req, _ := http.NewRequest("POST", "http://auth-service:8000/logout", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+token.Token)
+
+	resp, err = http.DefaultClient.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to log out")
+		t.FailNow()
+	}
+
+	// The revoked token should no longer validate, even though it has not expired
+	r, err := http.Get("http://auth-service:8000/validate/"+token.Token)
+
+	if err != nil || r.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to reject revoked JWT")
+		t.Fail()
+	}
+
+	resp, err = refresh(token.RefreshToken)
+
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to revoke refresh token on logout")
+		t.Fail()
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	data := url.Values{}
+	data.Set("username", "sebvet")
+	data.Set("password", "astonmartin")
+
+	resp, err := http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to sign in before JWKS unit test.")
+		t.FailNow()
+	}
+
+	var token Token
+	json.NewDecoder(resp.Body).Decode(&token)
+
+	// Read the algorithm and key ID from the JWT header
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID string `json:"kid"`
+	}
+	rawHeader, _ := base64.RawURLEncoding.DecodeString(strings.Split(token.Token, ".")[0])
+	json.Unmarshal(rawHeader, &header)
+
+	if header.Algorithm != "RS256" || header.KeyID == "" {
+		log.Println("Failed to sign JWT with RS256 and a kid header")
+		t.Fail()
+	}
+
+	resp, err = http.Get("http://auth-service:8000/.well-known/jwks.json")
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to fetch JWKS")
+		t.FailNow()
+	}
+
+	var keySet struct {
+		Keys []struct {
+			KeyID string `json:"kid"`
+		} `json:"keys"`
+	}
+	json.NewDecoder(resp.Body).Decode(&keySet)
+
+	found := false
+	for _, key := range keySet.Keys {
+		if key.KeyID == header.KeyID {
+			found = true
+		}
+	}
+
+	if !found {
+		log.Println("Failed to publish the key that signed the JWT")
+		t.Fail()
+	}
+}
+
+func TestRoles(t *testing.T) {
+	client := &http.Client{}
+	username := "rider" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	// New accounts are riders unless they ask to be drivers
+	data := url.Values{}
+	data.Set("username", username)
+	data.Set("name", "Rider Promoted")
+	data.Set("password", "r1derpassword")
+
+	resp, err := http.PostForm("http://auth-service:8000/register", data)
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		log.Println("Failed to register rider before roles unit test.")
+		t.FailNow()
+	}
+
+	var riderToken Token
+	json.NewDecoder(resp.Body).Decode(&riderToken)
+
+	// Riders cannot change roles
+	data = url.Values{}
+	data.Set("role", "driver")
+	req, _ := http.NewRequest("PUT", "http://auth-service:8000/users/"+username+"/roles", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+riderToken.Token)
+
+	resp, err = client.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		log.Println("Failed to stop a rider from changing roles")
+		t.Fail()
+	}
+
+	// Admins can
+	data = url.Values{}
+	data.Set("username", "admin")
+	data.Set("password", "pitwall2021")
+
+	resp, err = http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to sign in as admin")
+		t.FailNow()
+	}
+
+	var adminToken Token
+	json.NewDecoder(resp.Body).Decode(&adminToken)
+
+	data = url.Values{}
+	data.Set("role", "driver")
+	req, _ = http.NewRequest("PUT", "http://auth-service:8000/users/"+username+"/roles", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+adminToken.Token)
+
+	resp, err = client.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to change roles as admin")
+		t.FailNow()
+	}
+
+	// The new role should appear once the rider refreshes their token
+	resp, err = refresh(riderToken.RefreshToken)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to refresh token after role change")
+		t.FailNow()
+	}
+
+	var refreshed Token
+	json.NewDecoder(resp.Body).Decode(&refreshed)
+
+	var claims struct {
+		Roles []string `json:"roles"`
+	}
+	rawClaims, _ := base64.RawURLEncoding.DecodeString(strings.Split(refreshed.Token, ".")[1])
+	json.Unmarshal(rawClaims, &claims)
+
+	if len(claims.Roles) != 1 || claims.Roles[0] != "driver" {
+		log.Println("Failed to pick up role change on token refresh")
+		t.Fail()
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	// Use a fresh account so that locking it out does not affect the other tests
+	username := "lockout" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	data := url.Values{}
+	data.Set("username", username)
+	data.Set("name", "Locked Out")
+	data.Set("password", "l0ckoutpassword")
+
+	resp, err := http.PostForm("http://auth-service:8000/register", data)
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		log.Println("Failed to register account before lockout unit test.")
+		t.FailNow()
+	}
+
+	data = url.Values{}
+	data.Set("username", username)
+	data.Set("password", "wrongpassword1")
+
+	// Guesses made all at once must not get past the allowance of five. Those over it are told to wait.
+	statuses := make(chan int, 10)
+	for i := 0; i < cap(statuses); i++ {
+		go func() {
+			resp, err := http.PostForm("http://auth-service:8000/login", data)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+
+	rejected := 0
+	for i := 0; i < cap(statuses); i++ {
+		switch <-statuses {
+		case http.StatusUnauthorized:
+			rejected++
+		case http.StatusTooManyRequests:
+		default:
+			log.Println("Failed to answer concurrent wrong passwords with 401 or 429")
+			t.FailNow()
+		}
+	}
+
+	if rejected > 5 {
+		log.Printf("Failed to limit concurrent guesses: %d wrong passwords were checked", rejected)
+		t.FailNow()
+	}
+
+	// The rest of the first five wrong passwords are rejected as normal
+	for ; rejected < 5; rejected++ {
+		resp, err = http.PostForm("http://auth-service:8000/login", data)
+
+		if err != nil || resp.StatusCode != http.StatusUnauthorized {
+			log.Println("Failed to reject wrong password before lockout")
+			t.FailNow()
+		}
+	}
+
+	// After that the account is locked out, even with the right password
+	data.Set("password", "l0ckoutpassword")
+	resp, err = http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		log.Println("Failed to lock out account after repeated failures")
+		t.Fail()
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	username := "changepw" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	data := url.Values{}
+	data.Set("username", username)
+	data.Set("name", "Password Changer")
+	data.Set("password", "0ldpassword")
+
+	resp, err := http.PostForm("http://auth-service:8000/register", data)
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		log.Println("Failed to register account before password change unit test.")
+		t.FailNow()
+	}
+
+	var token Token
+	json.NewDecoder(resp.Body).Decode(&token)
+
+	changePassword := func(current, replacement string) *http.Response {
+		data := url.Values{}
+		data.Set("current_password", current)
+		data.Set("new_password", replacement)
+		req, _ := http.NewRequest("POST", "http://auth-service:8000/password", strings.NewReader(data.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Authorization", "Bearer "+token.Token)
+		resp, _ := http.DefaultClient.Do(req)
+		return resp
+	}
+
+	// The current password must be right
+	if resp := changePassword("wrongpassword1", "n3wpassword"); resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to reject password change with wrong current password")
+		t.Fail()
+	}
+
+	if resp := changePassword("0ldpassword", "n3wpassword"); resp == nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to change password")
+		t.FailNow()
+	}
+
+	// Only the new password should now work
+	data = url.Values{}
+	data.Set("username", username)
+	data.Set("password", "n3wpassword")
+	resp, err = http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to sign in with changed password")
+		t.Fail()
+	}
+
+	// Reset requests get the same response whether or not the account exists
+	for _, name := range []string{username, "nosuchuser"} {
+		data = url.Values{}
+		data.Set("username", name)
+		resp, err = http.PostForm("http://auth-service:8000/password/reset-request", data)
+
+		if err != nil || resp.StatusCode != http.StatusAccepted {
+			log.Println("Failed to accept password reset request")
+			t.Fail()
+		}
+	}
+
+	// Made-up reset tokens are rejected
+	data = url.Values{}
+	data.Set("token", "notarealresettoken")
+	data.Set("new_password", "an0therpassword")
+	resp, err = http.PostForm("http://auth-service:8000/password/reset", data)
+
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to reject invalid password reset token")
+		t.Fail()
+	}
+
+	// Guessing the current password is throttled like signing in
+	for i := 0; i < 5; i++ {
+		changePassword("wrongpassword1", "an0therpassword")
+	}
+
+	if resp := changePassword("n3wpassword", "an0therpassword"); resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		log.Println("Failed to throttle password change after repeated wrong passwords")
+		t.Fail()
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	username := "totpdriver" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	data := url.Values{}
+	data.Set("username", username)
+	data.Set("name", "Two Factor")
+	data.Set("password", "s3condfactor")
+	data.Set("role", "driver")
+
+	resp, err := http.PostForm("http://auth-service:8000/register", data)
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		log.Println("Failed to register driver before TOTP unit test.")
+		t.FailNow()
+	}
+
+	var token Token
+	json.NewDecoder(resp.Body).Decode(&token)
+
+	req, _ := http.NewRequest("POST", "http://auth-service:8000/totp/enrol", nil)
+	req.Header.Add("Authorization", "Bearer "+token.Token)
+	resp, err = http.DefaultClient.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to enrol in TOTP")
+		t.FailNow()
+	}
+
+	var enrolment struct {
+		Secret string `json:"secret"`
+		URI string `json:"otpauth_uri"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.NewDecoder(resp.Body).Decode(&enrolment)
+
+	if !strings.HasPrefix(enrolment.URI, "otpauth://totp/") || len(enrolment.RecoveryCodes) == 0 {
+		log.Println("Failed to return otpauth URI and recovery codes on enrolment")
+		t.FailNow()
+	}
+
+	// Confirm with a code generated from the secret, as an authenticator app would
+	secret, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrolment.Secret)
+	data = url.Values{}
+	data.Set("code", hotp(secret, time.Now().Unix() / totpPeriod))
+	req, _ = http.NewRequest("POST", "http://auth-service:8000/totp/confirm", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Authorization", "Bearer "+token.Token)
+	resp, err = http.DefaultClient.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to confirm TOTP enrolment")
+		t.FailNow()
+	}
+
+	// The password alone should now only earn a challenge
+	data = url.Values{}
+	data.Set("username", username)
+	data.Set("password", "s3condfactor")
+	resp, err = http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil {
+		log.Println("Failed to sign in before second step")
+		t.FailNow()
+	}
+
+	var challenge struct {
+		Token string `json:"token"`
+		TOTPRequired bool `json:"totp_required"`
+		ChallengeToken string `json:"challenge_token"`
+	}
+	json.NewDecoder(resp.Body).Decode(&challenge)
+
+	if resp.StatusCode != http.StatusAccepted || !challenge.TOTPRequired || challenge.Token != "" {
+		log.Println("Failed to require a second step at sign-in")
+		t.FailNow()
+	}
+
+	// The code used to confirm cannot be replayed, but a recovery code completes the sign-in
+	data = url.Values{}
+	data.Set("challenge_token", challenge.ChallengeToken)
+	data.Set("recovery_code", enrolment.RecoveryCodes[0])
+	resp, err = http.PostForm("http://auth-service:8000/login/totp", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to complete sign-in with a recovery code")
+		t.FailNow()
+	}
+
+	var completed Token
+	json.NewDecoder(resp.Body).Decode(&completed)
+
+	if completed.Token == "" {
+		log.Println("Failed to complete sign-in with a recovery code")
+		t.Fail()
+	}
+
+	// Signing in with the password again does not clear wrong codes, so five of them lock the account
+	for i := 0; i < 5; i++ {
+		data = url.Values{}
+		data.Set("username", username)
+		data.Set("password", "s3condfactor")
+		resp, err = http.PostForm("http://auth-service:8000/login", data)
+
+		if err != nil || resp.StatusCode != http.StatusAccepted {
+			log.Println("Failed to issue challenge before lockout")
+			t.FailNow()
+		}
+		json.NewDecoder(resp.Body).Decode(&challenge)
+
+		data = url.Values{}
+		data.Set("challenge_token", challenge.ChallengeToken)
+		data.Set("code", "000000")
+		http.PostForm("http://auth-service:8000/login/totp", data)
+	}
+
+	data = url.Values{}
+	data.Set("username", username)
+	data.Set("password", "s3condfactor")
+	resp, err = http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		log.Println("Failed to lock out account after repeated wrong codes")
+		t.Fail()
+	}
+}
+
+func introspect(clientID, clientSecret, token string) (*http.Response, error) {
+	data := url.Values{}
+	data.Set("token", token)
+	req, _ := http.NewRequest("POST", "http://auth-service:8000/introspect", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, clientSecret)
+	return http.DefaultClient.Do(req)
+}
+
+func TestIntrospect(t *testing.T) {
+	data := url.Values{}
+	data.Set("username", "babydriver")
+	data.Set("password", "edgarwright")
+
+	resp, err := http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to sign in before introspection unit test.")
+		t.FailNow()
+	}
+
+	var token Token
+	json.NewDecoder(resp.Body).Decode(&token)
+
+	// Unregistered services cannot introspect tokens
+	resp, err = introspect("roster-service", "wrong-secret", token.Token)
+
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to reject introspection with bad client credentials")
+		t.Fail()
+	}
+
+	var result struct {
+		Active bool `json:"active"`
+		Subject string `json:"sub"`
+		Roles []string `json:"roles"`
+		ExpiresAt int64 `json:"exp"`
+		IssuedAt int64 `json:"iat"`
+	}
+
+	resp, err = introspect("roster-service", "roster-dev-secret-change-me", token.Token)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to introspect valid token")
+		t.FailNow()
+	}
+
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	if !result.Active || result.Subject != "babydriver" || len(result.Roles) != 1 || result.Roles[0] != "driver" || result.ExpiresAt <= result.IssuedAt {
+		log.Println("Failed to describe valid token on introspection")
+		t.Fail()
+	}
+
+	// Tokens that fail verification are inactive, not an error
+	resp, err = introspect("roster-service", "roster-dev-secret-change-me", "not-a-jwt")
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to introspect invalid token")
+		t.FailNow()
+	}
+
+	result.Active = true
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	if result.Active {
+		log.Println("Failed to report invalid token as inactive")
+		t.Fail()
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+	data.Set("scope", "roster:read")
+	req, _ := http.NewRequest("POST", "http://auth-service:8000/oauth/token", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("integration-tests", "integration-tests-dev-secret")
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to issue service token")
+		t.FailNow()
+	}
+
+	var serviceToken struct {
+		AccessToken string `json:"access_token"`
+		TokenType string `json:"token_type"`
+		Scope string `json:"scope"`
+	}
+	json.NewDecoder(resp.Body).Decode(&serviceToken)
+
+	if serviceToken.TokenType != "Bearer" || serviceToken.Scope != "roster:read" {
+		log.Println("Failed to grant requested scope")
+		t.Fail()
+	}
+
+	// Service tokens introspect as the client, with their scope
+	resp, err = introspect("roster-service", "roster-dev-secret-change-me", serviceToken.AccessToken)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to introspect service token")
+		t.FailNow()
+	}
+
+	var result struct {
+		Active bool `json:"active"`
+		Subject string `json:"sub"`
+		Scope string `json:"scope"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	if !result.Active || result.Subject != "integration-tests" || result.Scope != "roster:read" {
+		log.Println("Failed to introspect service token")
+		t.Fail()
+	}
+
+	// Service tokens are not user tokens
+	r, err := http.Get("http://auth-service:8000/validate/" + serviceToken.AccessToken)
+
+	if err != nil || r.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to reject service token as a user token")
+		t.Fail()
+	}
+
+	// Clients cannot ask for scopes they were not registered with
+	data.Set("scope", "roster:write")
+	req, _ = http.NewRequest("POST", "http://auth-service:8000/oauth/token", strings.NewReader(data.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("integration-tests", "integration-tests-dev-secret")
+
+	resp, err = http.DefaultClient.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		log.Println("Failed to reject unregistered scope")
+		t.Fail()
+	}
+}
+
+func TestSessions(t *testing.T) {
+	signIn := func(device string) Token {
+		data := url.Values{}
+		data.Set("username", "babydriver")
+		data.Set("password", "edgarwright")
+		data.Set("device", device)
+		resp, err := http.PostForm("http://auth-service:8000/login", data)
+
+		if err != nil || resp.StatusCode != http.StatusOK {
+			log.Println("Failed to sign in before sessions unit test.")
+			t.FailNow()
+		}
+
+		var token Token
+		json.NewDecoder(resp.Body).Decode(&token)
+		return token
+	}
+
+	phone := signIn("Lost phone")
+	laptop := signIn("Laptop")
+
+	req, _ := http.NewRequest("GET", "http://auth-service:8000/sessions", nil)
+	req.Header.Add("Authorization", "Bearer "+laptop.Token)
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to list sessions")
+		t.FailNow()
+	}
+
+	var sessions []struct {
+		ID string `json:"id"`
+		Device string `json:"device"`
+		Current bool `json:"current"`
+	}
+	json.NewDecoder(resp.Body).Decode(&sessions)
+
+	phoneSession := ""
+	for _, session := range sessions {
+		if session.Device == "Lost phone" && !session.Current {
+			phoneSession = session.ID
+		}
+	}
+
+	if phoneSession == "" {
+		log.Println("Failed to list the phone's session")
+		t.FailNow()
+	}
+
+	// Sign the phone out from the laptop
+	req, _ = http.NewRequest("DELETE", "http://auth-service:8000/sessions/"+phoneSession, nil)
+	req.Header.Add("Authorization", "Bearer "+laptop.Token)
+	resp, err = http.DefaultClient.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to end session")
+		t.FailNow()
+	}
+
+	r, err := http.Get("http://auth-service:8000/validate/"+phone.Token)
+
+	if err != nil || r.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to reject access token of ended session")
+		t.Fail()
+	}
+
+	resp, err = refresh(phone.RefreshToken)
+
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to revoke refresh token of ended session")
+		t.Fail()
+	}
+
+	// The laptop is still signed in
+	r, err = http.Get("http://auth-service:8000/validate/"+laptop.Token)
+
+	if err != nil || r.StatusCode != http.StatusOK {
+		log.Println("Failed to keep other sessions when ending one")
+		t.Fail()
+	}
+}
+
+func adminRequest(method, path, adminToken string) (*http.Response, error) {
+	req, _ := http.NewRequest(method, "http://auth-service:8000"+path, nil)
+	req.Header.Add("Authorization", "Bearer "+adminToken)
+	return http.DefaultClient.Do(req)
+}
+
+func TestUserManagement(t *testing.T) {
+	username := "managed" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	data := url.Values{}
+	data.Set("username", username)
+	data.Set("name", "Managed User")
+	data.Set("password", "managed123")
+	resp, err := http.PostForm("http://auth-service:8000/register", data)
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		log.Println("Failed to register user before user management unit test.")
+		t.FailNow()
+	}
+
+	var userToken Token
+	json.NewDecoder(resp.Body).Decode(&userToken)
+
+	data = url.Values{}
+	data.Set("username", "admin")
+	data.Set("password", "pitwall2021")
+	resp, err = http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to sign in as admin before user management unit test.")
+		t.FailNow()
+	}
+
+	var adminToken Token
+	json.NewDecoder(resp.Body).Decode(&adminToken)
+
+	// Search for the new user
+	resp, err = adminRequest("GET", "/users?q="+username, adminToken.Token)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to search users")
+		t.FailNow()
+	}
+
+	var page struct {
+		Users []struct {
+			Username string `json:"username"`
+		} `json:"users"`
+		Total int `json:"total"`
+	}
+	json.NewDecoder(resp.Body).Decode(&page)
+
+	if page.Total != 1 || page.Users[0].Username != username {
+		log.Println("Failed to find user by search")
+		t.Fail()
+	}
+
+	// Suspension rejects existing tokens and new sign-ins
+	resp, err = adminRequest("POST", "/users/"+username+"/suspend", adminToken.Token)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to suspend user")
+		t.FailNow()
+	}
+
+	r, err := http.Get("http://auth-service:8000/validate/"+userToken.Token)
+
+	if err != nil || r.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to reject token of suspended user")
+		t.Fail()
+	}
+
+	data = url.Values{}
+	data.Set("username", username)
+	data.Set("password", "managed123")
+	resp, err = http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		log.Println("Failed to refuse sign-in of suspended user")
+		t.Fail()
+	}
+
+	resp, err = adminRequest("POST", "/users/"+username+"/reactivate", adminToken.Token)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to reactivate user")
+		t.Fail()
+	}
+
+	resp, err = http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to sign in after reactivation")
+		t.FailNow()
+	}
+
+	json.NewDecoder(resp.Body).Decode(&userToken)
+
+	// Deletion removes the account and rejects its tokens
+	resp, err = adminRequest("DELETE", "/users/"+username, adminToken.Token)
+
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		log.Println("Failed to delete user")
+		t.Fail()
+	}
+
+	r, err = http.Get("http://auth-service:8000/validate/"+userToken.Token)
+
+	if err != nil || r.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to reject token of deleted user")
+		t.Fail()
+	}
+
+	// Only admins can manage users
+	resp, err = adminRequest("GET", "/users", userToken.Token)
+
+	if err != nil || resp.StatusCode == http.StatusOK {
+		log.Println("Failed to stop a non-admin listing users")
+		t.Fail()
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	// Fail a sign-in so there is something to find
+	data := url.Values{}
+	data.Set("username", "sebvet")
+	data.Set("password", "notmypassword")
+	http.PostForm("http://auth-service:8000/login", data)
+
+	data = url.Values{}
+	data.Set("username", "admin")
+	data.Set("password", "pitwall2021")
+	resp, err := http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to sign in as admin before audit log unit test.")
+		t.FailNow()
+	}
+
+	var adminToken Token
+	json.NewDecoder(resp.Body).Decode(&adminToken)
+
+	since := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	resp, err = adminRequest("GET", "/audit?username=sebvet&type=login_failed&since="+since, adminToken.Token)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to query audit log")
+		t.FailNow()
+	}
+
+	var result struct {
+		Events []struct {
+			Type     string `json:"type"`
+			Username string `json:"username"`
+			Hash     string `json:"hash"`
+			PrevHash string `json:"prev_hash"`
+		} `json:"events"`
+		ChainIntact bool `json:"chain_intact"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	if len(result.Events) == 0 || result.Events[0].Type != "login_failed" || result.Events[0].Username != "sebvet" || result.Events[0].Hash == "" {
+		log.Println("Failed to find failed sign-in in audit log")
+		t.Fail()
+	}
+
+	if !result.ChainIntact {
+		log.Println("Failed to keep audit log hash chain intact")
+		t.Fail()
+	}
+
+	resp, err = adminRequest("GET", "/audit?since=yesterday", adminToken.Token)
+
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		log.Println("Failed to reject invalid audit time range")
+		t.Fail()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+var errClientUnauthorized = errors.New("client authentication failed")
+
+// A service that is allowed to call Auth's internal endpoints, such as token introspection.
+type serviceClient struct {
+	ID   string
+	Name string
+	// SHA-256 hash of the client secret. Secrets are long random strings, so a slow hash is not needed.
+	SecretHash string
+	// Scopes the client may request in service tokens.
+	Scopes []string
+}
+
+type clientRegistry struct {
+	mutex   sync.RWMutex
+	clients map[string]serviceClient
+}
+
+var serviceClients = &clientRegistry{clients: map[string]serviceClient{}}
+
+type clientFixture struct {
+	ID     string `json:"client_id"`
+	Name   string `json:"name"`
+	Secret string   `json:"client_secret"`
+	Scopes []string `json:"scopes"`
+}
+
+// Replaces the registered clients with those listed in the fixture file.
+func (c *clientRegistry) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var fixtures []clientFixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return err
+	}
+
+	clients := map[string]serviceClient{}
+	for _, fixture := range fixtures {
+		if fixture.ID == "" || fixture.Secret == "" {
+			return errors.New("client fixtures need a client_id and client_secret")
+		}
+		clients[fixture.ID] = serviceClient{
+			ID:         fixture.ID,
+			Name:       fixture.Name,
+			SecretHash: hashToken(fixture.Secret),
+			Scopes:     fixture.Scopes,
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clients = clients
+	return nil
+}
+
+// Reports whether the client is still registered, so that service tokens stop working when a client is removed.
+func (c *clientRegistry) isRegistered(id string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	_, ok := c.clients[id]
+	return ok
+}
+
+// Checks a client's id and secret.
+func (c *clientRegistry) authenticate(id, secret string) (serviceClient, error) {
+	c.mutex.RLock()
+	client, ok := c.clients[id]
+	c.mutex.RUnlock()
+
+	// The hash is compared even for unknown clients so that the response time does not reveal which ids exist.
+	expected := client.SecretHash
+	if !ok {
+		expected = hashToken("")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(hashToken(secret))) != 1 || !ok || secret == "" {
+		return serviceClient{}, errClientUnauthorized
+	}
+	return client, nil
+}
+
+// Authenticates the calling service from HTTP Basic credentials, falling back to
+// client_id and client_secret form values (RFC 6749 section 2.3.1).
+func authenticateClient(r *http.Request) (serviceClient, error) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	return serviceClients.authenticate(id, secret)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Returns the value of the environment variable key, or fallback if it is unset.
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Parses the environment variable key as a duration such as "5m" or "720h", or returns fallback if it is unset.
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Parses the environment variable key as an integer, or returns fallback if it is unset.
+func getEnvInt(key string, fallback int) (int, error) {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Response to a token introspection request (RFC 7662). Only active is set for tokens that are not active.
+type introspection struct {
+	Active    bool     `json:"active"`
+	TokenType string   `json:"token_type,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	TokenID   string   `json:"jti,omitempty"`
+}
+
+// Lets a registered service ask whether an access token is currently valid, and who it belongs to.
+// The token is sent in the body rather than the URL so that it does not end up in access logs.
+// Tokens that are expired, revoked or malformed are reported as inactive rather than as an error.
+func introspectToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	client, err := authenticateClient(r)
+
+	if err != nil {
+		log.Printf("Error: Introspection refused : %s", err)
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"auth-service\"")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"invalid_client\"}"))
+		return
+	}
+
+	rawToken := r.FormValue("token")
+	if rawToken == "" {
+		log.Printf("Error: Introspection by %s without a token", client.ID)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"invalid_request\"}"))
+		return
+	}
+
+	// Service tokens are told apart from user tokens by their client_id claim.
+	claims, err := parseToken(rawToken)
+	if err == nil {
+		if claims.ClientID != "" {
+			claims, err = verifyServiceToken(rawToken)
+		} else {
+			claims, _, err = verifyToken(rawToken)
+		}
+	}
+
+	if err != nil {
+		log.Printf("Token introspected by %s is inactive : %s", client.ID, err)
+		json.NewEncoder(w).Encode(introspection{Active: false})
+		return
+	}
+
+	log.Printf("Token of %s introspected by %s", claims.Principal(), client.ID)
+	json.NewEncoder(w).Encode(introspection{
+		Active:    true,
+		TokenType: "Bearer",
+		Subject:   claims.Subject,
+		Username:  claims.Username,
+		Name:      claims.Name,
+		Roles:     claims.Roles,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		IssuedAt:  claims.IssuedAt,
+		ExpiresAt: claims.ExpiresAt,
+		TokenID:   claims.Id,
+	})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// An RSA key used to sign tokens. Once a newer key takes over, the old one is retired:
+// it no longer signs anything but still verifies tokens until the grace window has passed.
+type signingKey struct {
+	ID        string
+	Private   *rsa.PrivateKey
+	RetiredAt time.Time
+}
+
+// The set of keys Auth currently signs and verifies tokens with.
+type keyRing struct {
+	mutex  sync.RWMutex
+	active *signingKey
+	keys   map[string]*signingKey
+	// Directory the keys are loaded from. Empty when running with a generated key.
+	dir   string
+	grace time.Duration
+}
+
+var signingKeys = &keyRing{}
+
+// Loads the keys from dir, or generates a single key if dir is empty.
+func (k *keyRing) init(dir string, grace time.Duration) error {
+	k.dir = dir
+	k.grace = grace
+
+	if dir != "" {
+		return k.reload()
+	}
+
+	log.Println("Warning: JWT_KEY_DIR is not set. Signing with a generated key that will change on restart.")
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	key := &signingKey{ID: keyID(&private.PublicKey), Private: private}
+	k.mutex.Lock()
+	k.active = key
+	k.keys = map[string]*signingKey{key.ID: key}
+	k.mutex.Unlock()
+	return nil
+}
+
+// Re-reads the PEM encoded RSA private keys in the key directory. The most recently modified key signs new tokens.
+// Every other key counts as retired from the time the next newer key was added, and is dropped once the grace window has passed.
+func (k *keyRing) reload() error {
+	paths, err := filepath.Glob(filepath.Join(k.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	type loadedKey struct {
+		key      *signingKey
+		modified time.Time
+	}
+	var loaded []loadedKey
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		private, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return fmt.Errorf("%s : %s", path, err)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		loaded = append(loaded, loadedKey{
+			key:      &signingKey{ID: keyID(&private.PublicKey), Private: private},
+			modified: info.ModTime(),
+		})
+	}
+
+	if len(loaded) == 0 {
+		return errors.New("no *.pem keys found in " + k.dir)
+	}
+
+	// Newest first
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].modified.After(loaded[j].modified)
+	})
+
+	keys := map[string]*signingKey{}
+	now := time.Now()
+
+	for i, entry := range loaded {
+		if i > 0 {
+			entry.key.RetiredAt = loaded[i-1].modified
+			if now.After(entry.key.RetiredAt.Add(k.grace)) {
+				continue
+			}
+		}
+		keys[entry.key.ID] = entry.key
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.active == nil || k.active.ID != loaded[0].key.ID {
+		log.Printf("Signing tokens with key %s", loaded[0].key.ID)
+	}
+	k.active = loaded[0].key
+	k.keys = keys
+	return nil
+}
+
+// Picks up rotated keys. A failed reload keeps the keys that were already loaded.
+func (k *keyRing) reloadEvery(interval time.Duration) {
+	if k.dir == "" {
+		return
+	}
+	for range time.Tick(interval) {
+		if err := k.reload(); err != nil {
+			log.Printf("Error: Could not reload signing keys : %s", err)
+		}
+	}
+}
+
+// Signs the claims with the active key, setting the kid header so verifiers can pick the right public key.
+func (k *keyRing) sign(claims jwt.Claims) (string, error) {
+	k.mutex.RLock()
+	active := k.active
+	k.mutex.RUnlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = active.ID
+	return token.SignedString(active.Private)
+}
+
+// Key function for jwt.Parse. Only RS256 tokens signed by a key that is active or within its grace window are accepted.
+func (k *keyRing) verificationKey(token *jwt.Token) (interface{}, error) {
+	if token.Method != jwt.SigningMethodRS256 {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	key, ok := k.keys[kid]
+	if !ok || (!key.RetiredAt.IsZero() && time.Now().After(key.RetiredAt.Add(k.grace))) {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return &key.Private.PublicKey, nil
+}
+
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+func encodeJWK(public *rsa.PublicKey) (modulus, exponent string) {
+	modulus = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+	exponent = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	return modulus, exponent
+}
+
+// RFC 7638 thumbprint of the public key, used as its kid.
+func keyID(public *rsa.PublicKey) string {
+	modulus, exponent := encodeJWK(public)
+	// Members must be in lexicographic order with no whitespace.
+	canonical := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, exponent, modulus)
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Publishes the public half of every key that can currently verify a token.
+func getJWKS(w http.ResponseWriter, r *http.Request) {
+	signingKeys.mutex.RLock()
+	keys := []jsonWebKey{}
+	for _, key := range signingKeys.keys {
+		modulus, exponent := encodeJWK(&key.Private.PublicKey)
+		keys = append(keys, jsonWebKey{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: "RS256",
+			KeyID:     key.ID,
+			Modulus:   modulus,
+			Exponent:  exponent,
+		})
+	}
+	signingKeys.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{Keys: keys})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Response of the token endpoint (RFC 6749 section 5.1).
+type serviceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// Writes an OAuth2 error response (RFC 6749 section 5.2).
+func oauthError(w http.ResponseWriter, status int, code string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"auth-service\"")
+	}
+	w.WriteHeader(status)
+	w.Write([]byte("{\"error\": \"" + code + "\"}"))
+}
+
+// Returns the scopes to grant for a request. An empty request gets every scope the client is allowed.
+func grantedScopes(client serviceClient, requested string) ([]string, bool) {
+	if strings.TrimSpace(requested) == "" {
+		return client.Scopes, true
+	}
+
+	allowed := map[string]bool{}
+	for _, scope := range client.Scopes {
+		allowed[scope] = true
+	}
+
+	var granted []string
+	for _, scope := range strings.Fields(requested) {
+		if !allowed[scope] {
+			return nil, false
+		}
+		granted = append(granted, scope)
+	}
+	return granted, true
+}
+
+// Client-credentials grant (RFC 6749 section 4.4). Registered services exchange their id and secret
+// for a short-lived service token carrying the scopes they asked for.
+func issueServiceToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	client, err := authenticateClient(r)
+
+	if err != nil {
+		log.Printf("Error: Service token refused : %s", err)
+		oauthError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	if grantType := r.FormValue("grant_type"); grantType != "client_credentials" {
+		log.Printf("Error: Client %s asked for unsupported grant type %q", client.ID, grantType)
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	scopes, ok := grantedScopes(client, r.FormValue("scope"))
+
+	if !ok {
+		log.Printf("Error: Client %s asked for scopes %q beyond its registration", client.ID, r.FormValue("scope"))
+		oauthError(w, http.StatusBadRequest, "invalid_scope")
+		return
+	}
+
+	scope := strings.Join(scopes, " ")
+	tokenString, err := createServiceToken(client, scope)
+
+	if err != nil {
+		log.Printf("Error: Could not create service token for client %s : %s", client.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not create JWT token\"}"))
+		return
+	}
+
+	log.Printf("Service token issued to client %s with scope %q.", client.ID, scope)
+	recordAudit(r, auditTokenIssued, "", map[string]string{"client_id": client.ID, "scope": scope})
+	json.NewEncoder(w).Encode(serviceTokenResponse{
+		AccessToken: tokenString,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(accessTokenTTL / time.Second),
+		Scope:       scope,
+	})
+}
+
+// Creates a signed JWT for a service. It has no username or roles, so it is never accepted where a user is expected.
+func createServiceToken(client serviceClient, scope string) (string, error) {
+	tokenID, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := &Claims{
+		Scope:    scope,
+		ClientID: client.ID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenID,
+			Subject:   client.ID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(accessTokenTTL).Unix(),
+		},
+	}
+
+	return signingKeys.sign(claims)
+}
+
+// Checks the signature, expiry and revocation status of a service token, and that its client is still registered.
+func verifyServiceToken(rawToken string) (*Claims, error) {
+	claims, err := parseToken(rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ClientID == "" || claims.Username != "" {
+		return nil, errors.New("not a service token")
+	}
+
+	if !serviceClients.isRegistered(claims.ClientID) {
+		return nil, errors.New("token issued to unknown client " + claims.ClientID)
+	}
+
+	return claims, nil
+}
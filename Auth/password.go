@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const passwordResetTTL = 30 * time.Minute
+
+// Notifier delivers password reset tokens to their owners.
+type Notifier interface {
+	SendPasswordReset(user User, token string, expiresAt time.Time) error
+}
+
+// Writes reset tokens to the service log. Only suitable for development.
+type logNotifier struct{}
+
+func (logNotifier) SendPasswordReset(user User, token string, expiresAt time.Time) error {
+	log.Printf("Password reset token for user %s (expires %s): %s", user.Username, expiresAt.Format(time.RFC3339), token)
+	return nil
+}
+
+// Appends reset tokens to a JSON lines file, standing in for an email or SMS gateway.
+type outboxNotifier struct {
+	path string
+}
+
+var outboxMutex sync.Mutex
+
+func (n outboxNotifier) SendPasswordReset(user User, token string, expiresAt time.Time) error {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+
+	file, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(struct {
+		Type      string    `json:"type"`
+		Username  string    `json:"username"`
+		Name      string    `json:"name"`
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{"password_reset", user.Username, user.Name, token, expiresAt})
+}
+
+var notifier Notifier = logNotifier{}
+
+type passwordReset struct {
+	Username  string
+	ExpiresAt time.Time
+}
+
+// Outstanding reset tokens, keyed by their SHA-256 hash.
+type passwordResetStore struct {
+	mutex  sync.Mutex
+	resets map[string]passwordReset
+}
+
+var passwordResets = &passwordResetStore{resets: map[string]passwordReset{}}
+
+func (s *passwordResetStore) issue(username string) (string, time.Time, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(passwordResetTTL)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.resets[hashToken(raw)] = passwordReset{Username: username, ExpiresAt: expiresAt}
+	return raw, expiresAt, nil
+}
+
+// Returns the username an outstanding token was issued for, without using it up.
+func (s *passwordResetStore) lookup(raw string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	reset, ok := s.resets[hashToken(raw)]
+	if !ok || time.Now().After(reset.ExpiresAt) {
+		return "", false
+	}
+	return reset.Username, true
+}
+
+// Returns the username the token was issued for. A token can only be consumed once, and consuming it
+// also cancels any other outstanding reset for the same user.
+func (s *passwordResetStore) consume(raw string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	reset, ok := s.resets[hashToken(raw)]
+	if !ok || time.Now().After(reset.ExpiresAt) {
+		return "", false
+	}
+
+	for key, other := range s.resets {
+		if other.Username == reset.Username {
+			delete(s.resets, key)
+		}
+	}
+	return reset.Username, true
+}
+
+func (s *passwordResetStore) pruneEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mutex.Lock()
+		now := time.Now()
+		for key, reset := range s.resets {
+			if now.After(reset.ExpiresAt) {
+				delete(s.resets, key)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// Hashes and stores a new password for the user.
+func setPassword(username, password string) (User, error) {
+	hashedPassword, err := hashSaltPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	return accounts.Update(username, func(user *User) error {
+		user.PasswordHash = hashedPassword
+		user.PasswordResetRequired = false
+		return nil
+	})
+}
+
+// Ends every session the user has: outstanding access tokens stop validating and refresh tokens are revoked.
+// If change is not nil, it is applied to the account in the same update, e.g. to suspend it.
+func revokeSessions(username string, change func(*User)) (User, error) {
+	now := time.Now()
+	sessions.endUser(username)
+	userRevocations.revoke(username, now)
+
+	return accounts.Update(username, func(user *User) error {
+		if change != nil {
+			change(user)
+		}
+		user.TokensValidAfter = now
+		return nil
+	})
+}
+
+// Requires authentication. Changes the caller's password after checking their current one.
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+
+	_, user, err := verifyToken(bearerToken(r))
+
+	if err != nil {
+		log.Printf("Password change rejected : %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"Invalid or incorrect JWT token received.\"}"))
+		return
+	}
+
+	// The current password is throttled like a sign-in, so that a stolen token cannot be used to guess it
+	ip := clientIP(r)
+	if wait := loginAttempts.reserve(user.Username, ip); wait > 0 {
+		log.Printf("Password change for user %s from %s refused during lockout.", user.Username, ip)
+		writeLockedOut(w, wait)
+		return
+	}
+	defer loginAttempts.release(user.Username, ip)
+
+	if !verifyPassword(user.PasswordHash, r.FormValue("current_password")) {
+		log.Printf("Password change rejected for user %s: wrong current password", user.Username)
+		recordAudit(r, auditLoginFailed, user.Username, map[string]string{"reason": "incorrect_current_password"})
+
+		if loginAttempts.recordFailure(user.Username, ip) {
+			log.Printf("Sign-in locked out for user %s from %s.", user.Username, ip)
+			recordAudit(r, auditLockout, user.Username, nil)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"Incorrect credentials provided\"}"))
+		return
+	}
+
+	newPassword := r.FormValue("new_password")
+
+	if err := validatePassword(user.Username, newPassword); err != nil {
+		log.Printf("Password change rejected for user %s: %s", user.Username, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err)))
+		return
+	}
+
+	if _, err := setPassword(user.Username, newPassword); err != nil {
+		log.Printf("Error: Could not change password for user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not change password\"}"))
+		return
+	}
+
+	loginAttempts.recordSuccess(user.Username)
+	log.Printf("Password changed for user %s.", user.Username)
+	recordAudit(r, auditPasswordChanged, user.Username, nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Sends a reset token to the named user. The response is the same whether or not the user exists,
+// so that this endpoint cannot be used to discover usernames.
+func requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+
+	username := r.FormValue("username")
+
+	if user, err := accounts.Get(username); err == nil {
+		if err := sendPasswordReset(user); err != nil {
+			log.Printf("Error: Could not send password reset for user %s : %s", username, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("{\"error\": \"Could not send password reset\"}"))
+			return
+		}
+	} else {
+		log.Printf("Password reset requested for unknown user %s", username)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("{\"message\": \"If the account exists, a password reset token has been sent\"}"))
+}
+
+func sendPasswordReset(user User) error {
+	token, expiresAt, err := passwordResets.issue(user.Username)
+	if err != nil {
+		return err
+	}
+
+	if err := notifier.SendPasswordReset(user, token, expiresAt); err != nil {
+		return err
+	}
+
+	log.Printf("Password reset token issued for user %s.", user.Username)
+	return nil
+}
+
+// Sets a new password using a reset token, then signs the user out everywhere.
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.FormValue("token")
+	newPassword := r.FormValue("new_password")
+
+	// Check the new password before using up the token, so that a weak choice can be corrected.
+	username, ok := passwordResets.lookup(token)
+
+	if ok {
+		if err := validatePassword(username, newPassword); err != nil {
+			log.Printf("Password reset rejected for user %s: %s", username, err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("{\"error\": \"%s\"}", err)))
+			return
+		}
+		username, ok = passwordResets.consume(token)
+	}
+
+	if !ok {
+		log.Println("Password reset rejected: invalid or expired reset token")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"Invalid or expired reset token\"}"))
+		return
+	}
+
+	_, err := setPassword(username, newPassword)
+
+	if err == ErrAccountNotFound {
+		log.Printf("Password reset rejected for unknown user %s", username)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"Invalid or expired reset token\"}"))
+		return
+	}
+
+	if err == nil {
+		_, err = revokeSessions(username, nil)
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not reset password for user %s : %s", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not reset password\"}"))
+		return
+	}
+
+	log.Printf("Password reset for user %s. Existing sessions revoked.", username)
+	recordAudit(r, auditPasswordChanged, username, map[string]string{"reason": "reset_token"})
+	w.WriteHeader(http.StatusOK)
+}
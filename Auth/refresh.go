@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+var errRefreshTokenReused = errors.New("refresh token has already been used")
+
+// A refresh token can be exchanged once. Exchanging it issues the next token in the same family,
+// so the family traces every token descended from a single sign-in.
+type refreshToken struct {
+	Username  string
+	Family    string
+	ExpiresAt time.Time
+	Used      bool
+}
+
+// Server-side record of issued refresh tokens. Tokens are keyed by their SHA-256 hash
+// so that the raw values are never held after they have been handed out.
+type refreshTokenStore struct {
+	mutex  sync.Mutex
+	tokens map[string]*refreshToken
+}
+
+var refreshTokens = &refreshTokenStore{tokens: map[string]*refreshToken{}}
+
+// Returns a random URL-safe string built from n random bytes.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issues a new refresh token for username in the given family.
+func (s *refreshTokenStore) issue(username, family string) (string, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.tokens[hashToken(raw)] = &refreshToken{
+		Username:  username,
+		Family:    family,
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	}
+	return raw, nil
+}
+
+// Marks the refresh token as used and returns its record so the caller can issue the next token in the family.
+// Presenting a token that has already been used means it has leaked, so the whole family is revoked.
+func (s *refreshTokenStore) consume(raw string) (refreshToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	token, ok := s.tokens[hashToken(raw)]
+	if !ok || time.Now().After(token.ExpiresAt) {
+		return refreshToken{}, errRefreshTokenInvalid
+	}
+
+	if token.Used {
+		s.revokeFamilyLocked(token.Family)
+		return *token, errRefreshTokenReused
+	}
+
+	token.Used = true
+	return *token, nil
+}
+
+// Revokes the family of the given refresh token, provided it belongs to username.
+func (s *refreshTokenStore) revokeToken(raw, username string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if token, ok := s.tokens[hashToken(raw)]; ok && token.Username == username {
+		s.revokeFamilyLocked(token.Family)
+	}
+}
+
+// Removes every refresh token issued to username.
+func (s *refreshTokenStore) revokeUser(username string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, token := range s.tokens {
+		if token.Username == username {
+			delete(s.tokens, key)
+		}
+	}
+}
+
+// Removes every token in the family, used or not.
+func (s *refreshTokenStore) revokeFamily(family string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.revokeFamilyLocked(family)
+}
+
+func (s *refreshTokenStore) revokeFamilyLocked(family string) {
+	for key, token := range s.tokens {
+		if token.Family == family {
+			delete(s.tokens, key)
+		}
+	}
+}
+
+// Periodically drops expired tokens. Used tokens are kept until they expire so that reuse can still be detected.
+func (s *refreshTokenStore) pruneEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mutex.Lock()
+		now := time.Now()
+		for key, token := range s.tokens {
+			if now.After(token.ExpiresAt) {
+				delete(s.tokens, key)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func refreshAccessToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+
+	previous, err := refreshTokens.consume(r.FormValue("refresh_token"))
+
+	if err == errRefreshTokenReused {
+		sessions.end(previous.Family, previous.Username)
+		log.Printf("Refresh token reuse detected for user %s. Ended session %s.", previous.Username, previous.Family)
+		recordAudit(r, auditTokenRevoked, previous.Username, map[string]string{"reason": "refresh_token_reused", "session": previous.Family})
+	}
+
+	if err != nil {
+		log.Printf("Refresh rejected : %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"Invalid or expired refresh token\"}"))
+		return
+	}
+
+	// Re-read the account so that changes since sign-in are reflected in the new access token
+	user, err := accounts.Get(previous.Username)
+
+	if err == nil && user.Suspended {
+		err = errors.New("user is suspended")
+	}
+
+	if err != nil {
+		log.Printf("Refresh rejected for user %s : %s", previous.Username, err)
+		sessions.end(previous.Family, previous.Username)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"Invalid or expired refresh token\"}"))
+		return
+	}
+
+	userInfo, err := issueTokens(r, user, previous.Family)
+
+	if err != nil {
+		log.Printf("Error: Could not create JWT for user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not create JWT token\"}"))
+		return
+	}
+
+	log.Printf("JWT Token refreshed for user %s.", user.Username)
+	json.NewEncoder(w).Encode(userInfo)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Records access tokens that were revoked before they expired, keyed by their jti claim.
+// Each entry remembers when its token expires so it can be dropped once the token would be rejected anyway.
+type revocationList struct {
+	mutex   sync.RWMutex
+	revoked map[string]time.Time
+}
+
+var revokedTokens = &revocationList{revoked: map[string]time.Time{}}
+
+// Records sessions that have ended, keyed by their ID. Auth checks its session store directly, but services
+// that verify tokens locally learn of them through the revocation feed. An entry is only needed until every
+// access token issued in the session has expired.
+var endedSessions = &revocationList{revoked: map[string]time.Time{}}
+
+func (l *revocationList) revoke(tokenID string, expiresAt time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.revoked[tokenID] = expiresAt
+}
+
+func (l *revocationList) isRevoked(tokenID string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	_, ok := l.revoked[tokenID]
+	return ok
+}
+
+// Returns the revoked IDs with the Unix time each stops being needed, for the revocation feed.
+func (l *revocationList) list() []revokedID {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	ids := make([]revokedID, 0, len(l.revoked))
+	for id, expiresAt := range l.revoked {
+		ids = append(ids, revokedID{ID: id, ExpiresAt: expiresAt.Unix()})
+	}
+	return ids
+}
+
+func (l *revocationList) pruneEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.mutex.Lock()
+		now := time.Now()
+		for tokenID, expiresAt := range l.revoked {
+			if now.After(expiresAt) {
+				delete(l.revoked, tokenID)
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// Revokes the caller's access token and ends the session it was issued in, so that the session cannot be renewed.
+// If a refresh token is also supplied, its whole family is revoked as well.
+func logout(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+
+	claims, _, err := verifyToken(bearerToken(r))
+
+	if err != nil {
+		log.Printf("Logout rejected : %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"Invalid or incorrect JWT token received.\"}"))
+		return
+	}
+
+	revokedTokens.revoke(claims.Id, time.Unix(claims.ExpiresAt, 0))
+
+	if claims.SessionID != "" {
+		sessions.end(claims.SessionID, claims.Username)
+	}
+
+	if refreshToken := r.FormValue("refresh_token"); refreshToken != "" {
+		refreshTokens.revokeToken(refreshToken, claims.Username)
+	}
+
+	log.Printf("User %s logged out.", claims.Username)
+	recordAudit(r, auditTokenRevoked, claims.Username, map[string]string{"reason": "logout", "session": claims.SessionID})
+	w.WriteHeader(http.StatusOK)
+}
+
+// Records users whose tokens were all revoked at once, e.g. on suspension, deletion or a password reset.
+// Services that verify tokens locally poll this through GET /revocations, along with the revoked tokens and
+// ended sessions, since they cannot see the account store.
+// An entry is only needed until every token issued before it has expired.
+type userRevocationList struct {
+	mutex     sync.RWMutex
+	notBefore map[string]time.Time
+}
+
+var userRevocations = &userRevocationList{notBefore: map[string]time.Time{}}
+
+func (l *userRevocationList) revoke(username string, at time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.notBefore[username] = at
+}
+
+func (l *userRevocationList) pruneEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.mutex.Lock()
+		cutoff := time.Now().Add(-accessTokenTTL)
+		for username, at := range l.notBefore {
+			if at.Before(cutoff) {
+				delete(l.notBefore, username)
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+type userRevocation struct {
+	Username  string `json:"username"`
+	NotBefore int64  `json:"not_before"`
+}
+
+type revokedID struct {
+	ID        string `json:"id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// Requires a service token with the auth:revocations scope. Lists users whose tokens issued before
+// not_before must be rejected, the jti of each token revoked on logout, and the sid of each ended session.
+func getRevocations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userRevocations.mutex.RLock()
+	users := make([]userRevocation, 0, len(userRevocations.notBefore))
+	for username, at := range userRevocations.notBefore {
+		users = append(users, userRevocation{Username: username, NotBefore: at.Unix()})
+	}
+	userRevocations.mutex.RUnlock()
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Users    []userRevocation `json:"users"`
+		Tokens   []revokedID      `json:"tokens"`
+		Sessions []revokedID      `json:"sessions"`
+	}{users, revokedTokens.list(), endedSessions.list()})
+}
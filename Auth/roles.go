@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
+)
+
+// Lets the shared middleware check tokens against Auth's own keys and revocation list.
+type localVerifier struct{}
+
+func (localVerifier) Verify(raw string) (*Claims, error) {
+	claims, _, err := verifyToken(raw)
+	return claims, err
+}
+
+func bearerTokenExtractor(r *http.Request) (string, error) {
+	return bearerToken(r), nil
+}
+
+var requireAdmin = authclient.RequireRole(localVerifier{}, bearerTokenExtractor, authclient.RoleAdmin)
+
+var knownRoles = map[string]bool{
+	authclient.RoleRider:  true,
+	authclient.RoleDriver: true,
+	authclient.RoleAdmin:  true,
+}
+
+// Replaces a user's roles. Tokens already issued keep their old roles until they are refreshed.
+func setRoles(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+
+	username := mux.Vars(r)["username"]
+	roles := r.Form["role"]
+
+	for _, role := range roles {
+		if !knownRoles[role] {
+			log.Printf("Error: Unknown role %q for user %s", role, username)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"error\": \"Unknown role supplied\"}"))
+			return
+		}
+	}
+
+	user, err := accounts.Update(username, func(user *User) error {
+		user.Roles = roles
+		return nil
+	})
+
+	if err == ErrAccountNotFound {
+		log.Printf("Error: Cannot set roles of unknown user %s", username)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{\"error\": \"User not found\"}"))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not update roles of user %s : %s", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not update roles\"}"))
+		return
+	}
+
+	admin, _ := authclient.ClaimsFromContext(r.Context())
+	log.Printf("Roles of user %s set to %v by %s", username, roles, admin.Username)
+	recordAudit(r, auditRoleChanged, username, map[string]string{"roles": strings.Join(roles, " ")})
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
+)
+
+const maxDeviceLength = 64
+
+// A signed-in device. Each session is one refresh token family, so its ID is the family's,
+// and access tokens issued in it carry the ID in their sid claim.
+type session struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"-"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// Pushed back every time the session is refreshed, in step with its refresh token.
+	ExpiresAt time.Time `json:"-"`
+	// Set in responses to mark the session the request was made from.
+	Current bool `json:"current"`
+}
+
+type sessionStore struct {
+	mutex    sync.RWMutex
+	sessions map[string]*session
+}
+
+var sessions = &sessionStore{sessions: map[string]*session{}}
+
+// Records a new session for username, described by the sign-in request.
+// Clients can name the device with a "device" form value.
+func (s *sessionStore) start(username string, r *http.Request) (string, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	device := strings.TrimSpace(r.FormValue("device"))
+	if len(device) > maxDeviceLength {
+		device = device[:maxDeviceLength]
+	}
+
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions[id] = &session{
+		ID:         id,
+		Username:   username,
+		Device:     device,
+		IP:         clientIP(r),
+		UserAgent:  r.UserAgent(),
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(refreshTokenTTL),
+	}
+	return id, nil
+}
+
+// Reports whether the session is still active.
+func (s *sessionStore) isActive(id string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.sessions[id]
+	return ok
+}
+
+// Records that the session was refreshed from r, extending it in step with its new refresh token.
+func (s *sessionStore) touch(id string, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if current, ok := s.sessions[id]; ok {
+		current.LastUsedAt = time.Now()
+		current.IP = clientIP(r)
+		current.ExpiresAt = current.LastUsedAt.Add(refreshTokenTTL)
+	}
+}
+
+// Returns the user's sessions, most recently used first.
+func (s *sessionStore) list(username string) []session {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	list := []session{}
+	for _, current := range s.sessions {
+		if current.Username == username {
+			list = append(list, *current)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastUsedAt.After(list[j].LastUsedAt) })
+	return list
+}
+
+// Ends the session if it belongs to username, revoking its refresh tokens. Access tokens issued in it
+// are rejected from then on because their sid no longer names an active session, and other services
+// are told through the revocation feed.
+func (s *sessionStore) end(id, username string) bool {
+	s.mutex.Lock()
+	current, ok := s.sessions[id]
+	if ok && current.Username == username {
+		delete(s.sessions, id)
+	}
+	s.mutex.Unlock()
+
+	if !ok || current.Username != username {
+		return false
+	}
+	endedSessions.revoke(id, time.Now().Add(accessTokenTTL))
+	refreshTokens.revokeFamily(id)
+	return true
+}
+
+// Ends every session the user has. Callers also revoke the user's tokens through userRevocations,
+// so the sessions do not need to go in the revocation feed one by one.
+func (s *sessionStore) endUser(username string) {
+	s.mutex.Lock()
+	for id, current := range s.sessions {
+		if current.Username == username {
+			delete(s.sessions, id)
+		}
+	}
+	s.mutex.Unlock()
+
+	refreshTokens.revokeUser(username)
+}
+
+func (s *sessionStore) pruneEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mutex.Lock()
+		now := time.Now()
+		for id, current := range s.sessions {
+			if now.After(current.ExpiresAt) {
+				delete(s.sessions, id)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// Requires authentication. Lists where the caller is signed in.
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims, _, err := verifyToken(bearerToken(r))
+
+	if err != nil {
+		log.Printf("Session list rejected : %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"Invalid or incorrect JWT token received.\"}"))
+		return
+	}
+
+	list := sessions.list(claims.Username)
+	for i := range list {
+		list[i].Current = list[i].ID == claims.SessionID
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+}
+
+// Requires authentication. Signs the caller out of one of their sessions, e.g. on a lost phone.
+func endSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	claims, _, err := verifyToken(bearerToken(r))
+
+	if err != nil {
+		log.Printf("Session revocation rejected : %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"Invalid or incorrect JWT token received.\"}"))
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+
+	// Other users' sessions are reported as not found so that their IDs cannot be probed
+	if !sessions.end(id, claims.Username) {
+		log.Printf("Error: User %s tried to end unknown session %s", claims.Username, id)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{\"error\": \"Session not found\"}"))
+		return
+	}
+
+	log.Printf("User %s ended session %s.", claims.Username, id)
+	recordAudit(r, auditTokenRevoked, claims.Username, map[string]string{"reason": "session_ended", "session": id})
+	w.WriteHeader(http.StatusOK)
+}
+
+// Requires authentication as an admin. Signs a user out everywhere.
+func endUserSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	username := mux.Vars(r)["username"]
+	user, err := accounts.Get(username)
+
+	if err != nil {
+		log.Printf("Error: Cannot end sessions of unknown user %s", username)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{\"error\": \"User not found\"}"))
+		return
+	}
+
+	if _, err := revokeSessions(user.Username, nil); err != nil {
+		log.Printf("Error: Could not end sessions of user %s : %s", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not end sessions\"}"))
+		return
+	}
+
+	admin, _ := authclient.ClaimsFromContext(r.Context())
+	log.Printf("All sessions of user %s ended by %s", username, admin.Username)
+	recordAudit(r, auditTokenRevoked, username, map[string]string{"reason": "all_sessions_ended"})
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+)
+
+var ErrAccountNotFound = errors.New("account not found")
+var ErrAccountExists = errors.New("account already exists")
+
+// AccountStore holds user accounts. Implementations must be safe for concurrent use.
+type AccountStore interface {
+	Get(username string) (User, error)
+	// Create adds a new account, returning ErrAccountExists if the username is taken.
+	Create(user User) error
+	// Update applies change to an existing account and stores the result, returning ErrAccountNotFound
+	// if there is none. No other change to the account can happen in between. If change returns an error,
+	// nothing is stored and that error is returned.
+	Update(username string, change func(*User) error) (User, error)
+	// Delete removes an account, returning ErrAccountNotFound if there is none.
+	Delete(username string) error
+	// List returns every account, ordered by username.
+	List() ([]User, error)
+}
+
+// Keeps accounts in a map. Everything is lost when the service restarts.
+type memoryAccountStore struct {
+	mutex    sync.RWMutex
+	accounts map[string]User
+}
+
+func newMemoryAccountStore() *memoryAccountStore {
+	return &memoryAccountStore{accounts: map[string]User{}}
+}
+
+func (s *memoryAccountStore) Get(username string) (User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	user, ok := s.accounts[username]
+	if !ok {
+		return User{}, ErrAccountNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryAccountStore) Create(user User) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.accounts[user.Username]; ok {
+		return ErrAccountExists
+	}
+	s.accounts[user.Username] = user
+	return nil
+}
+
+func (s *memoryAccountStore) Update(username string, change func(*User) error) (User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, ok := s.accounts[username]
+	if !ok {
+		return User{}, ErrAccountNotFound
+	}
+	if err := change(&user); err != nil {
+		return User{}, err
+	}
+	s.accounts[username] = user
+	return user, nil
+}
+
+func (s *memoryAccountStore) Delete(username string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.accounts[username]; !ok {
+		return ErrAccountNotFound
+	}
+	delete(s.accounts, username)
+	return nil
+}
+
+func (s *memoryAccountStore) List() ([]User, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	users := make([]User, 0, len(s.accounts))
+	for _, user := range s.accounts {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+// Builds the account store selected by ACCOUNT_STORE ("memory" or "bolt").
+func newAccountStore() (AccountStore, error) {
+	switch kind := getEnv("ACCOUNT_STORE", "memory"); kind {
+	case "memory":
+		return newMemoryAccountStore(), nil
+	case "bolt":
+		return newBoltAccountStore(getEnv("ACCOUNT_DB_PATH", "accounts.db"))
+	default:
+		return nil, errors.New("unknown ACCOUNT_STORE " + kind)
+	}
+}
+
+type accountFixture struct {
+	Username string   `json:"username"`
+	Name     string   `json:"name"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+}
+
+// Adds the accounts listed in the fixture file to the store.
+// Accounts that already exist are left alone so that a persistent store keeps any changes made since.
+func seedAccounts(store AccountStore, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var fixtures []accountFixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return err
+	}
+
+	for _, fixture := range fixtures {
+		if existing, err := store.Get(fixture.Username); err == nil {
+			// Accounts stored before roles existed pick up the fixture's roles.
+			if len(existing.Roles) == 0 && len(fixture.Roles) > 0 {
+				_, err := store.Update(fixture.Username, func(user *User) error {
+					if len(user.Roles) == 0 {
+						user.Roles = fixture.Roles
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		hashedPassword, err := hashSaltPassword(fixture.Password)
+		if err != nil {
+			return err
+		}
+
+		err = store.Create(User{
+			Username:     fixture.Username,
+			Name:         fixture.Name,
+			Roles:        fixture.Roles,
+			PasswordHash: hashedPassword,
+		})
+		if err != nil && err != ErrAccountExists {
+			return err
+		}
+		log.Printf("Seeded account %s from %s", fixture.Username, path)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var accountsBucket = []byte("accounts")
+
+// Keeps accounts in a BoltDB file so they survive restarts.
+// Records are gob encoded, since the JSON encoding of User deliberately omits the password hash.
+type boltAccountStore struct {
+	db *bolt.DB
+}
+
+func newBoltAccountStore(path string) (*boltAccountStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(accountsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltAccountStore{db: db}, nil
+}
+
+func (s *boltAccountStore) Get(username string) (User, error) {
+	var user User
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(accountsBucket).Get([]byte(username))
+		if data == nil {
+			return ErrAccountNotFound
+		}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(&user)
+	})
+	return user, err
+}
+
+func (s *boltAccountStore) Create(user User) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(accountsBucket)
+		if bucket.Get([]byte(user.Username)) != nil {
+			return ErrAccountExists
+		}
+		return putAccount(bucket, user)
+	})
+}
+
+func (s *boltAccountStore) Update(username string, change func(*User) error) (User, error) {
+	var user User
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(accountsBucket)
+		data := bucket.Get([]byte(username))
+		if data == nil {
+			return ErrAccountNotFound
+		}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&user); err != nil {
+			return err
+		}
+		if err := change(&user); err != nil {
+			return err
+		}
+		return putAccount(bucket, user)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *boltAccountStore) Delete(username string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(accountsBucket)
+		if bucket.Get([]byte(username)) == nil {
+			return ErrAccountNotFound
+		}
+		return bucket.Delete([]byte(username))
+	})
+}
+
+// Bolt keeps keys in byte order, so the accounts come out ordered by username.
+func (s *boltAccountStore) List() ([]User, error) {
+	users := []User{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(accountsBucket).ForEach(func(_, data []byte) error {
+			var user User
+			if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&user); err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	return users, err
+}
+
+func putAccount(bucket *bolt.Bucket, user User) error {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(user); err != nil {
+		return err
+	}
+	return bucket.Put([]byte(user.Username), buffer.Bytes())
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxFailuresPerUsername = 5
+const maxFailuresPerIP = 20
+const baseLockout = 30 * time.Second
+const maxLockout = 15 * time.Minute
+
+// Failures are forgotten after this long without another failure.
+const failureMemory = time.Hour
+
+// How long a caller is told to wait when the attempts already in progress could use up what is left
+// of an allowance. They may try again as soon as those attempts have been checked.
+const pendingRetry = time.Second
+
+type failureRecord struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+	// Attempts reserved but not yet released, whose password or code is still being checked
+	Pending int
+}
+
+// Tracks failed sign-ins per username and per client IP. Once a key passes its failure allowance,
+// each further failure locks it out for twice as long as the last, up to maxLockout.
+type loginThrottle struct {
+	mutex      sync.Mutex
+	byUsername map[string]*failureRecord
+	byIP       map[string]*failureRecord
+}
+
+var loginAttempts = &loginThrottle{
+	byUsername: map[string]*failureRecord{},
+	byIP:       map[string]*failureRecord{},
+}
+
+// Returns how long the caller must wait before trying again, or 0 if they may try now.
+// It reserves nothing, so it only suits a cheap check made ahead of reserve.
+func (t *loginThrottle) retryAfter(username, ip string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.wait(username, ip, time.Now())
+}
+
+// Reserves an attempt for the username and IP, or returns how long the caller must wait before trying again.
+// Checking the lockout and counting the attempt happen under one lock, so that guesses made in parallel
+// cannot all pass the check before any of them fails. A reserved attempt must be released once it has been
+// recorded as a success or failure, or abandoned.
+func (t *loginThrottle) reserve(username, ip string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	if wait := t.wait(username, ip, now); wait > 0 {
+		return wait
+	}
+	if username != "" {
+		getRecord(t.byUsername, username, now).Pending++
+	}
+	getRecord(t.byIP, ip, now).Pending++
+	return 0
+}
+
+// Releases an attempt taken with reserve.
+func (t *loginThrottle) release(username, ip string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, record := range []*failureRecord{t.byUsername[username], t.byIP[ip]} {
+		if record != nil && record.Pending > 0 {
+			record.Pending--
+		}
+	}
+}
+
+func (t *loginThrottle) wait(username, ip string, now time.Time) time.Duration {
+	wait := time.Duration(0)
+	if username != "" {
+		wait = t.byUsername[username].wait(now, maxFailuresPerUsername)
+	}
+	if ipWait := t.byIP[ip].wait(now, maxFailuresPerIP); ipWait > wait {
+		wait = ipWait
+	}
+	return wait
+}
+
+func (record *failureRecord) wait(now time.Time, allowance int) time.Duration {
+	if record == nil {
+		return 0
+	}
+	if record.LockedUntil.After(now) {
+		return record.LockedUntil.Sub(now)
+	}
+
+	// Any attempt in progress may yet fail, so no more may run at once than there are failures left
+	// before a lockout. Past the allowance each failure locks the key again, so one at a time.
+	left := allowance
+	if now.Sub(record.LastFailure) <= failureMemory {
+		left -= record.Failures
+	}
+	if left < 1 {
+		left = 1
+	}
+	if record.Pending >= left {
+		return pendingRetry
+	}
+	return 0
+}
+
+// Records a failed sign-in. Returns true if the failure caused a new lockout.
+func (t *loginThrottle) recordFailure(username, ip string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	lockedUser := addFailure(t.byUsername, username, maxFailuresPerUsername)
+	lockedIP := addFailure(t.byIP, ip, maxFailuresPerIP)
+	return lockedUser || lockedIP
+}
+
+// Returns the record for key, starting it afresh if its failures have been forgotten.
+// Attempts still pending on a forgotten record are kept.
+func getRecord(records map[string]*failureRecord, key string, now time.Time) *failureRecord {
+	record, ok := records[key]
+	if !ok {
+		record = &failureRecord{}
+		records[key] = record
+	} else if now.Sub(record.LastFailure) > failureMemory && now.After(record.LockedUntil) {
+		*record = failureRecord{Pending: record.Pending}
+	}
+	return record
+}
+
+func addFailure(records map[string]*failureRecord, key string, allowance int) bool {
+	now := time.Now()
+	record := getRecord(records, key, now)
+
+	record.Failures++
+	record.LastFailure = now
+
+	if record.Failures < allowance {
+		return false
+	}
+
+	lockout := time.Duration(float64(baseLockout) * math.Pow(2, float64(record.Failures-allowance)))
+	if lockout > maxLockout || lockout <= 0 {
+		lockout = maxLockout
+	}
+	record.LockedUntil = now.Add(lockout)
+	return true
+}
+
+// Clears the username's failures after a successful sign-in. The IP's failures are kept,
+// so that signing in to one account does not reset an attack on others from the same address.
+// Attempts still pending for the username are kept, so that they are released correctly.
+func (t *loginThrottle) recordSuccess(username string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if record, ok := t.byUsername[username]; ok {
+		*record = failureRecord{Pending: record.Pending}
+	}
+}
+
+func (t *loginThrottle) pruneEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		t.mutex.Lock()
+		now := time.Now()
+		for _, records := range []map[string]*failureRecord{t.byUsername, t.byIP} {
+			for key, record := range records {
+				if now.Sub(record.LastFailure) > failureMemory && now.After(record.LockedUntil) && record.Pending == 0 {
+					delete(records, key)
+				}
+			}
+		}
+		t.mutex.Unlock()
+	}
+}
+
+// Tells the caller they are locked out and how many seconds to wait before trying again.
+func writeLockedOut(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("{\"error\": \"Too many failed sign-in attempts. Try again later.\"}"))
+}
+
+// Returns the address of the client that opened the connection.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
+)
+
+// RFC 6238 parameters. These are the defaults every authenticator app understands.
+const totpPeriod = 30
+const totpDigits = 6
+
+// Codes from one period either side of the current one are accepted to allow for clock drift.
+const totpSkew = 1
+
+const totpIssuer = "EasyRide"
+const recoveryCodeCount = 10
+const totpChallengeTTL = 5 * time.Minute
+const maxChallengeAttempts = 5
+
+var errTOTPEnabled = errors.New("two-factor authentication is already enabled")
+var errTOTPNotEnrolled = errors.New("not enrolled in two-factor authentication")
+var errIncorrectTOTPCode = errors.New("incorrect code")
+
+var requireTOTPUser = authclient.RequireRole(localVerifier{}, bearerTokenExtractor, authclient.RoleDriver, authclient.RoleAdmin)
+
+// Computes the HOTP value (RFC 4226) for the given counter.
+func hotp(secret []byte, counter int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// Checks a TOTP code against the user's secret and returns the time step it matched.
+// Steps at or before lastStep are refused so that a code cannot be replayed.
+func verifyTOTP(encodedSecret, code string, lastStep int64) (int64, bool) {
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encodedSecret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(hotp(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func newTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// Recovery codes look like "k3f9-x2mq". Only their hashes are stored.
+func newRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		code := raw[:4] + "-" + raw[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// Removes the recovery code from the user if it is one of theirs.
+func useRecoveryCode(user *User, code string) bool {
+	hashed := hashToken(strings.ToLower(strings.TrimSpace(code)))
+	for i, candidate := range user.RecoveryCodes {
+		if hmac.Equal([]byte(candidate), []byte(hashed)) {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// A sign-in that has passed the password check and is waiting for a TOTP code.
+type totpChallenge struct {
+	Username  string
+	ExpiresAt time.Time
+	Attempts  int
+}
+
+type totpChallengeStore struct {
+	mutex      sync.Mutex
+	challenges map[string]*totpChallenge
+}
+
+var totpChallenges = &totpChallengeStore{challenges: map[string]*totpChallenge{}}
+
+func (s *totpChallengeStore) issue(username string) (string, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.challenges[hashToken(raw)] = &totpChallenge{Username: username, ExpiresAt: time.Now().Add(totpChallengeTTL)}
+	return raw, nil
+}
+
+// Returns the username waiting on the challenge. Each call counts as an attempt, and the challenge
+// is discarded after too many attempts so that codes cannot be guessed.
+func (s *totpChallengeStore) attempt(raw string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := hashToken(raw)
+	challenge, ok := s.challenges[key]
+	if !ok || time.Now().After(challenge.ExpiresAt) {
+		delete(s.challenges, key)
+		return "", false
+	}
+
+	challenge.Attempts++
+	if challenge.Attempts >= maxChallengeAttempts {
+		delete(s.challenges, key)
+	}
+	return challenge.Username, true
+}
+
+func (s *totpChallengeStore) complete(raw string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.challenges, hashToken(raw))
+}
+
+func (s *totpChallengeStore) pruneEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mutex.Lock()
+		now := time.Now()
+		for key, challenge := range s.challenges {
+			if now.After(challenge.ExpiresAt) {
+				delete(s.challenges, key)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// Requires authentication as a driver or admin. Generates a new TOTP secret and recovery codes.
+// Two-factor sign-in is not switched on until a code from the new secret is confirmed at /totp/confirm.
+func enrolTOTP(w http.ResponseWriter, r *http.Request) {
+	claims, _ := authclient.ClaimsFromContext(r.Context())
+
+	secret, err := newTOTPSecret()
+	var codes, hashes []string
+	if err == nil {
+		codes, hashes, err = newRecoveryCodes()
+	}
+
+	var user User
+	if err == nil {
+		user, err = accounts.Update(claims.Username, func(user *User) error {
+			if user.TOTPEnabled {
+				return errTOTPEnabled
+			}
+			user.TOTPSecret = secret
+			user.TOTPLastStep = 0
+			user.RecoveryCodes = hashes
+			return nil
+		})
+	}
+
+	if err == ErrAccountNotFound {
+		log.Printf("Error: TOTP enrolment for unknown user %s", claims.Username)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{\"error\": \"User not found\"}"))
+		return
+	}
+
+	if err == errTOTPEnabled {
+		log.Printf("Error: User %s is already enrolled in TOTP", claims.Username)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("{\"error\": \"Two-factor authentication is already enabled\"}"))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not enrol user %s in TOTP : %s", claims.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not enrol in two-factor authentication\"}"))
+		return
+	}
+
+	label := url.PathEscape(totpIssuer + ":" + user.Username)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	log.Printf("TOTP enrolment started for user %s.", user.Username)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Secret        string   `json:"secret"`
+		URI           string   `json:"otpauth_uri"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		Secret:        secret,
+		URI:           "otpauth://totp/" + label + "?" + query.Encode(),
+		RecoveryCodes: codes,
+	})
+}
+
+// Requires authentication as a driver or admin. Switches on two-factor sign-in once the user proves
+// their authenticator app has the secret.
+func confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	claims, _ := authclient.ClaimsFromContext(r.Context())
+
+	// The code is checked inside the update so that it cannot be used twice by requests arriving together
+	user, err := accounts.Update(claims.Username, func(user *User) error {
+		if user.TOTPSecret == "" {
+			return errTOTPNotEnrolled
+		}
+
+		step, ok := verifyTOTP(user.TOTPSecret, r.FormValue("code"), user.TOTPLastStep)
+		if !ok {
+			return errIncorrectTOTPCode
+		}
+
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		return nil
+	})
+
+	if err == ErrAccountNotFound || err == errTOTPNotEnrolled {
+		log.Printf("Error: TOTP confirmation for user %s without enrolment", claims.Username)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Enrol in two-factor authentication first\"}"))
+		return
+	}
+
+	if err == errIncorrectTOTPCode {
+		log.Printf("TOTP confirmation failed for user %s", claims.Username)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"Incorrect code provided\"}"))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not enable TOTP for user %s : %s", claims.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not enable two-factor authentication\"}"))
+		return
+	}
+
+	log.Printf("TOTP enabled for user %s.", user.Username)
+	recordAudit(r, auditTOTPEnabled, user.Username, nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Second step of signing in for users with TOTP enabled. Exchanges the challenge token from /login
+// and a TOTP code (or a recovery code) for the real tokens.
+func signInTOTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+
+	challenge := r.FormValue("challenge_token")
+	ip := clientIP(r)
+
+	if wait := loginAttempts.retryAfter("", ip); wait > 0 {
+		log.Printf("TOTP sign-in from %s refused during lockout.", ip)
+		recordAudit(r, auditLoginFailed, "", map[string]string{"reason": "locked_out"})
+		writeLockedOut(w, wait)
+		return
+	}
+
+	username, ok := totpChallenges.attempt(challenge)
+
+	if !ok {
+		log.Println("TOTP sign-in rejected: invalid or expired challenge")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"Invalid or expired challenge token\"}"))
+		return
+	}
+
+	// Wrong codes count against the username as well as the IP, so the username's lockout applies here too
+	if wait := loginAttempts.reserve(username, ip); wait > 0 {
+		log.Printf("TOTP sign-in of user %s from %s refused during lockout.", username, ip)
+		recordAudit(r, auditLoginFailed, username, map[string]string{"reason": "locked_out"})
+		writeLockedOut(w, wait)
+		return
+	}
+	defer loginAttempts.release(username, ip)
+
+	// Saves the used time step or recovery code in the same update, so neither can be used again
+	user, err := accounts.Update(username, func(user *User) error {
+		if code := r.FormValue("recovery_code"); code != "" {
+			ok = useRecoveryCode(user, code)
+		} else {
+			var step int64
+			if step, ok = verifyTOTP(user.TOTPSecret, r.FormValue("code"), user.TOTPLastStep); ok {
+				user.TOTPLastStep = step
+			}
+		}
+
+		if !ok {
+			return errIncorrectTOTPCode
+		}
+		return nil
+	})
+
+	if err == ErrAccountNotFound || err == errIncorrectTOTPCode {
+		log.Printf("TOTP sign-in of user %s failed.", username)
+		recordAudit(r, auditLoginFailed, username, map[string]string{"reason": "incorrect_code"})
+
+		if loginAttempts.recordFailure(username, ip) {
+			log.Printf("Sign-in locked out for user %s from %s.", username, ip)
+			recordAudit(r, auditLockout, username, nil)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("{\"error\": \"Incorrect code provided\"}"))
+		return
+	}
+
+	totpChallenges.complete(challenge)
+
+	// The account may have been suspended since the password was checked
+	if err == nil && !checkAccountStanding(w, r, user) {
+		return
+	}
+
+	var userInfo tokenResponse
+	if err == nil {
+		userInfo, err = issueTokens(r, user, "")
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not create JWT for user %s : %s", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not create JWT token\"}"))
+		return
+	}
+
+	loginAttempts.recordSuccess(username)
+	json.NewEncoder(w).Encode(userInfo)
+	log.Printf("JWT Token successfully created for user %s after TOTP.", username)
+}
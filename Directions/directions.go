@@ -10,12 +10,16 @@ import (
 	"regexp"
 
 	"github.com/gorilla/mux"
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
 	"googlemaps.github.io/maps"
 )
 
 type Route struct {
 	TotalDistance int `json:"totaldistance`
 	ARoadDistance int `json:"aroaddistance`
+	// Where the journey starts, so that drivers who do not work there can be left out.
+	StartLat float64 `json:"start_lat"`
+	StartLng float64 `json:"start_lng"`
 } 
 
 // Calculate the distance of A roads within a journey
@@ -34,7 +38,7 @@ func calcARoadDistance(s []maps.Route) int {
 }
 
 
-func getRouteDistanceHelper(origin, destination string) (distance, aRoadDistance int, err error) {
+func getRouteDistanceHelper(origin, destination string) (distance, aRoadDistance int, start maps.LatLng, err error) {
 	// Make sure you insert your API Key to access the Google Directions API
 	c, err := maps.NewClient(maps.WithAPIKey(os.Getenv("MAPS_API_KEY")))
 	if err != nil {
@@ -48,7 +52,7 @@ func getRouteDistanceHelper(origin, destination string) (distance, aRoadDistance
 	route, _, err := c.Directions(context.Background(), r)
 	if err != nil {
 		log.Fatalf("fatal error: %s", err)
-		return 0, 0, err
+		return 0, 0, maps.LatLng{}, err
 	}
 
 	// Distance made on A road
@@ -57,7 +61,7 @@ func getRouteDistanceHelper(origin, destination string) (distance, aRoadDistance
 	// Total distance of the journey in meters
 	distTotal := route[0].Legs[0].Distance.Meters
 
-	return distTotal, distA, nil
+	return distTotal, distA, route[0].Legs[0].StartLocation, nil
 }
 
 func getRouteDistance(w http.ResponseWriter, r *http.Request) {
@@ -65,7 +69,7 @@ func getRouteDistance(w http.ResponseWriter, r *http.Request) {
 	origin := vars["from"]
 	destination := vars["to"]
 
-	totalDistance, aRoadDistance, err := getRouteDistanceHelper(origin, destination)
+	totalDistance, aRoadDistance, start, err := getRouteDistanceHelper(origin, destination)
 
 	if err != nil {
 		log.Printf("Error: Could not find route between %s and %s : %s", origin, destination, err)
@@ -77,6 +81,8 @@ func getRouteDistance(w http.ResponseWriter, r *http.Request) {
 	route := Route{
 		TotalDistance: totalDistance,
 		ARoadDistance: aRoadDistance,
+		StartLat: start.Lat,
+		StartLng: start.Lng,
 	}
 	log.Printf("Finding distance between %s and %s", origin, destination)
 	w.WriteHeader(http.StatusOK)
@@ -84,8 +90,17 @@ func getRouteDistance(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleRequests() {
+	jwksURL := os.Getenv("AUTH_JWKS_URL")
+	if jwksURL == "" {
+		jwksURL = authclient.DefaultJWKSURL
+	}
+
+	// Only services holding a token with the directions:read scope may look up routes,
+	// since every lookup is billed to our Google Maps key.
+	requireDirectionsRead := authclient.RequireScope(authclient.NewVerifier(jwksURL), authclient.BearerToken, "directions:read")
+
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/directions/{from}/{to}", getRouteDistance).Methods("GET")
+	router.Handle("/directions/{from}/{to}", requireDirectionsRead(http.HandlerFunc(getRouteDistance))).Methods("GET")
 	log.Fatal(http.ListenAndServe(":8000", router))
 }
 
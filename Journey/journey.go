@@ -5,9 +5,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
+	"github.com/matt-drayton/easy-ride/Shared/ukclock"
 )
 
 type driver struct {
@@ -19,8 +25,13 @@ type driver struct {
 type route struct {
 	TotalDistance int `json:"totaldistance`
 	ARoadDistance int `json:"aroaddistance`
+	StartLat float64 `json:"start_lat"`
+	StartLng float64 `json:"start_lng"`
 } 
 
+// A full UK postcode, such as "EX4 4QJ".
+var postcodePattern = regexp.MustCompile(`^[A-Za-z]{1,2}[0-9][A-Za-z0-9]? ?[0-9][A-Za-z]{2}$`)
+
 type journey struct {
 	StartPoint string `json:"start_point"`
 	EndPoint string `json:"end_point"`
@@ -28,16 +39,37 @@ type journey struct {
 	ARoadDistance int `json:"a_road_distance"`
 	BestDriver driver `json:"best_driver"`
 	Cost int `json:"cost"`
+	At time.Time `json:"at"`
 }
 
+// Calls Roster and Directions with a service token from the auth service.
+var services *http.Client
+
 func getJourney(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	vars := mux.Vars(r)
 	origin := vars["from"]
 	destination := vars["to"]
 
+	// Journeys can be priced for a future time, using the rates drivers will charge then.
+	at := time.Now()
+	if value := r.URL.Query().Get("at"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			log.Printf("Error: Invalid journey time %s", value)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("{\"error\": \"at must be an RFC 3339 time\"}"))
+			return
+		}
+		at = parsed
+	}
+
 	// Get route distance
-	resp, err := http.Get(fmt.Sprintf("http://directions-service:8000/directions/%s/%s", origin, destination))
+	resp, err := services.Get(fmt.Sprintf("http://directions-service:8000/directions/%s/%s", origin, destination))
+
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("directions service returned %s", resp.Status)
+	}
 
 	if err != nil {
 		log.Printf("Error: Could not fetch route between %s and %s : %s", origin, destination, err)
@@ -49,8 +81,35 @@ func getJourney(w http.ResponseWriter, r *http.Request) {
 	var distances route
 	json.NewDecoder(resp.Body).Decode(&distances)
 
+	// Riders can ask for a particular kind of vehicle. Roster does the filtering.
+	rosterQuery := url.Values{}
+	for _, name := range []string{"min_seats", "fuel_type", "accessibility"} {
+		if value := r.URL.Query().Get(name); value != "" {
+			rosterQuery.Set(name, value)
+		}
+	}
+	rosterQuery.Set("at", at.Format(time.RFC3339))
+
+	// Only drivers who work where the journey starts
+	if distances.StartLat != 0 || distances.StartLng != 0 {
+		rosterQuery.Set("pickup_lat", strconv.FormatFloat(distances.StartLat, 'f', -1, 64))
+		rosterQuery.Set("pickup_lng", strconv.FormatFloat(distances.StartLng, 'f', -1, 64))
+	}
+	if postcodePattern.MatchString(origin) {
+		rosterQuery.Set("pickup_postcode", origin)
+	}
+
 	// Get cheapest driver
-	resp, err = http.Get("http://roster-service:8000/roster")
+	resp, err = services.Get("http://roster-service:8000/roster?" + rosterQuery.Encode())
+	if err == nil && resp.StatusCode == http.StatusBadRequest {
+		log.Printf("Error: Roster rejected vehicle requirements %s", rosterQuery.Encode())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Invalid vehicle requirements\"}"))
+		return
+	}
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("roster service returned %s", resp.Status)
+	}
 	if err != nil {
 		log.Printf("Error fetching roster: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -70,7 +129,7 @@ func getJourney(w http.ResponseWriter, r *http.Request) {
 
 	cheapestDriver := getCheapestDriver(fetchedDrivers)
 
-	cost := calculateCost(distances, fetchedDrivers)
+	cost := calculateCost(distances, fetchedDrivers, at)
 
 	response := journey {
 		StartPoint: origin,
@@ -79,6 +138,7 @@ func getJourney(w http.ResponseWriter, r *http.Request) {
 		ARoadDistance: distances.ARoadDistance,
 		BestDriver: cheapestDriver,
 		Cost: cost,
+		At: at,
 	}
 
 	log.Println(fmt.Sprintf("Journey between %s and %s calculated at %dp with driver %s", origin, destination, cost, 
@@ -88,7 +148,7 @@ func getJourney(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func calculateCost(routeDetails route, availableDrivers []driver) int {
+func calculateCost(routeDetails route, availableDrivers []driver, at time.Time) int {
 	cheapestDriver := getCheapestDriver(availableDrivers)
 	noOfDrivers := len(availableDrivers)
 
@@ -104,7 +164,8 @@ func calculateCost(routeDetails route, availableDrivers []driver) int {
 		cost *= 2
 	}
 
-	currentHour, _, _ := time.Now().Clock()
+	// Night hours are wall clock times in the UK, whatever time zone a journey's time was given in
+	currentHour, _, _ := at.In(ukclock.Location).Clock()
 
 	if currentHour >= 23 || currentHour <= 6 {
 		cost *= 2
@@ -144,5 +205,13 @@ func handleRequests() {
 
 func main() {
 	log.Println("Starting Journey Service")
+
+	tokenURL := os.Getenv("AUTH_TOKEN_URL")
+	if tokenURL == "" {
+		tokenURL = authclient.DefaultTokenURL
+	}
+	credentials := authclient.NewClientCredentials(tokenURL, os.Getenv("AUTH_CLIENT_ID"), os.Getenv("AUTH_CLIENT_SECRET"), "roster:read", "directions:read")
+	services = credentials.Client()
+
 	handleRequests()
 }
\ No newline at end of file
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
+)
+
+// Kinds of roster change streamed on GET /roster/events.
+const (
+	eventJoined          = "joined"
+	eventLeft            = "left"
+	eventRateChanged     = "rate_changed"
+	eventLocationUpdated = "location_updated"
+	eventStateChanged    = "state_changed"
+	// Sent when a client resumes from an event that is no longer in the log, so that it knows to fetch
+	// the whole roster again.
+	eventReset = "reset"
+)
+
+// Reasons a driver left the roster other than leaving themselves, or went offline other than by changing state.
+const (
+	reasonHoursLimit       = "hours_limit"
+	reasonShiftEnded       = "shift_ended"
+	reasonMissedHeartbeats = "missed_heartbeats"
+)
+
+// The most recent events are kept in memory so that clients can resume after a dropped connection.
+// Overridden by EVENT_LOG_SIZE.
+const defaultEventLogSize = 1000
+
+// A subscriber that falls this far behind is disconnected rather than holding up everyone else.
+// It can reconnect and resume from the last event it received.
+const subscriberBuffer = 256
+
+// Sent on idle streams so that proxies do not close them.
+const eventKeepAlive = 15 * time.Second
+
+const eventWriteWait = 10 * time.Second
+
+// Events are held in memory only, so the log starts again when Roster restarts. Event IDs are prefixed with
+// the time the log was created, so that an ID from before a restart is never mistaken for a recent one.
+var events = newEventLog(defaultEventLogSize)
+
+type rosterEvent struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Username string    `json:"username,omitempty"`
+	At       time.Time `json:"at"`
+	// The driver's record after the change. Left out of location updates, which carry the position instead.
+	Driver   *driver   `json:"driver,omitempty"`
+	Location *position `json:"location,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+
+	seq uint64
+}
+
+// A bounded log of recent roster events, and the streams waiting for new ones. It is safe for concurrent use.
+type eventLog struct {
+	size  int
+	epoch string
+
+	mutex   sync.Mutex
+	lastSeq uint64
+	// Oldest first.
+	recent      []rosterEvent
+	subscribers map[chan rosterEvent]bool
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{
+		size:        size,
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		subscribers: map[chan rosterEvent]bool{},
+	}
+}
+
+// Adds an event to the log and sends it to every subscriber.
+func (l *eventLog) publish(e rosterEvent) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.lastSeq++
+	e.seq = l.lastSeq
+	e.ID = l.epoch + "-" + strconv.FormatUint(e.seq, 10)
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+
+	l.recent = append(l.recent, e)
+	if len(l.recent) > l.size {
+		l.recent = append([]rosterEvent(nil), l.recent[len(l.recent)-l.size:]...)
+	}
+
+	for ch := range l.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(l.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Reports whether lastEventID was issued by this log, and its position in it.
+func (l *eventLog) parseID(lastEventID string) (uint64, bool) {
+	parts := strings.SplitN(lastEventID, "-", 2)
+	if len(parts) != 2 || parts[0] != l.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	return seq, err == nil && seq <= l.lastSeq
+}
+
+// Starts a subscription. The events after lastEventID are returned to be sent first, or a reset event if some of
+// them are no longer held. No ID means the subscriber only wants new events. The channel is closed if the
+// subscriber falls behind; call cancel once done with it.
+func (l *eventLog) subscribe(lastEventID string) (backlog []rosterEvent, ch chan rosterEvent, cancel func()) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if lastEventID != "" {
+		seq, ok := l.parseID(lastEventID)
+		oldest := l.lastSeq + 1
+		if len(l.recent) > 0 {
+			oldest = l.recent[0].seq
+		}
+
+		if !ok || seq+1 < oldest {
+			reset := rosterEvent{ID: l.epoch + "-" + strconv.FormatUint(l.lastSeq, 10), Type: eventReset, At: time.Now()}
+			backlog = append(backlog, reset)
+		} else {
+			for _, e := range l.recent {
+				if e.seq > seq {
+					backlog = append(backlog, e)
+				}
+			}
+		}
+	}
+
+	ch = make(chan rosterEvent, subscriberBuffer)
+	l.subscribers[ch] = true
+
+	cancel = func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if l.subscribers[ch] {
+			delete(l.subscribers, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, cancel
+}
+
+func writeServerSentEvent(w http.ResponseWriter, e rosterEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// Browsers cannot set headers on a WebSocket, so they may offer their token as a subprotocol instead.
+// The handshake fails unless the server agrees to the bearer subprotocol in reply.
+// Any origin is accepted, so that dashboards served from elsewhere can connect. The default same-origin check
+// stops pages from riding on a visitor's cookies, which Roster does not use: every handshake must carry a token
+// the page holds itself.
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{authclient.BearerProtocol},
+	CheckOrigin:  func(r *http.Request) bool { return true },
+}
+
+// Requires a service token with the roster:read scope, sent in the Authorization header or, for browsers,
+// as described by authclient.StreamToken. Streams roster changes as Server-Sent Events, or as JSON messages
+// over a WebSocket if the request asks to upgrade. Send the ID of the last event received in the
+// Last-Event-ID header, or in last_event_id, to resume from it.
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		streamEventsOverWebSocket(w, r, lastEventID)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("Error: Response does not support streaming.")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not stream roster events\"}"))
+		return
+	}
+
+	backlog, ch, cancel := events.subscribe(lastEventID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for _, e := range backlog {
+		if err := writeServerSentEvent(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				log.Println("Error: Roster event stream fell behind and was closed.")
+				return
+			}
+			if err := writeServerSentEvent(w, e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func streamEventsOverWebSocket(w http.ResponseWriter, r *http.Request, lastEventID string) {
+	// Upgrade replies to the client itself if it fails
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error: Could not open roster event WebSocket : %s", err)
+		return
+	}
+	defer conn.Close()
+
+	backlog, ch, cancel := events.subscribe(lastEventID)
+	defer cancel()
+
+	// Clients do not send anything, but reading is needed to answer pings and to notice when they go away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(e rosterEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(eventWriteWait))
+		return conn.WriteJSON(e)
+	}
+
+	for _, e := range backlog {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				log.Println("Error: Roster event WebSocket fell behind and was closed.")
+				message := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Fell behind, resume from the last event received")
+				conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(eventWriteWait))
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventWriteWait)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
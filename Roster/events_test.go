@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
+)
+
+func TestEventLogResume(t *testing.T) {
+	l := newEventLog(3)
+	_, live, cancel := l.subscribe("")
+	defer cancel()
+
+	for _, username := range []string{"babydriver", "sebvet", "walker", "kimi"} {
+		l.publish(rosterEvent{Type: eventJoined, Username: username})
+	}
+
+	var received []rosterEvent
+	for i := 0; i < 4; i++ {
+		received = append(received, <-live)
+	}
+
+	// Resuming from walker's event gives only the events after it
+	backlog, _, cancelResume := l.subscribe(received[2].ID)
+	cancelResume()
+
+	if len(backlog) != 1 || backlog[0].Username != "kimi" {
+		log.Printf("Failed to resume from event %s, got %v", received[2].ID, backlog)
+		t.Fail()
+	}
+
+	// babydriver's event has fallen out of the log, but nothing after it has
+	backlog, _, cancelResume = l.subscribe(received[0].ID)
+	cancelResume()
+
+	if len(backlog) != 3 || backlog[0].Username != "sebvet" {
+		log.Printf("Failed to resume from event that has just left the log, got %v", backlog)
+		t.Fail()
+	}
+
+	// Once sebvet's event has gone too, a subscriber resuming from babydriver's would miss it
+	l.publish(rosterEvent{Type: eventLeft, Username: "kimi"})
+	backlog, _, cancelResume = l.subscribe(received[0].ID)
+	cancelResume()
+
+	if len(backlog) != 1 || backlog[0].Type != eventReset || backlog[0].ID != l.recent[2].ID {
+		log.Printf("Failed to reset subscriber who missed events, got %v", backlog)
+		t.Fail()
+	}
+
+	// IDs from before a restart are not trusted
+	backlog, _, cancelResume = newEventLog(3).subscribe(received[3].ID)
+	cancelResume()
+
+	if len(backlog) != 1 || backlog[0].Type != eventReset {
+		log.Printf("Failed to reset subscriber resuming from another log, got %v", backlog)
+		t.Fail()
+	}
+}
+
+func TestEventLogDropsSlowSubscriber(t *testing.T) {
+	l := newEventLog(defaultEventLogSize)
+	_, slow, cancel := l.subscribe("")
+	defer cancel()
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		l.publish(rosterEvent{Type: eventLocationUpdated, Username: "babydriver"})
+	}
+
+	for range slow {
+	}
+
+	if len(l.subscribers) != 0 {
+		log.Println("Failed to drop subscriber that fell behind")
+		t.Fail()
+	}
+}
+
+func TestStreamEventsServerSent(t *testing.T) {
+	events = newEventLog(defaultEventLogSize)
+	events.publish(rosterEvent{Type: eventJoined, Username: "babydriver"})
+	first := events.recent[0]
+
+	server := httptest.NewServer(http.HandlerFunc(streamEvents))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Last-Event-ID", first.ID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.Header.Get("Content-Type") != "text/event-stream" {
+		log.Println("Failed to open event stream")
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+
+	events.publish(rosterEvent{Type: eventRateChanged, Username: "babydriver", Reason: rateChanged})
+
+	lines := bufio.NewScanner(resp.Body)
+	var fields []string
+	for len(fields) < 3 && lines.Scan() {
+		if lines.Text() != "" {
+			fields = append(fields, lines.Text())
+		}
+	}
+
+	if len(fields) != 3 || fields[0] != "id: "+events.recent[1].ID || fields[1] != "event: rate_changed" ||
+		!strings.HasPrefix(fields[2], "data: ") {
+		log.Printf("Failed to stream event, got %q", fields)
+		t.Fail()
+	}
+}
+
+func TestStreamEventsWebSocket(t *testing.T) {
+	events = newEventLog(defaultEventLogSize)
+	events.publish(rosterEvent{Type: eventJoined, Username: "babydriver"})
+	first := events.recent[0]
+
+	server := httptest.NewServer(http.HandlerFunc(streamEvents))
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("Last-Event-ID", first.ID)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		log.Printf("Failed to open event WebSocket : %s", err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	events.publish(rosterEvent{Type: eventStateChanged, Username: "babydriver", Driver: &driver{Username: "babydriver", State: stateOnBreak}})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+
+	var e rosterEvent
+	if err == nil {
+		err = json.Unmarshal(message, &e)
+	}
+
+	if err != nil || e.Type != eventStateChanged || e.Driver == nil || e.Driver.State != stateOnBreak {
+		log.Printf("Failed to stream event over WebSocket, got %s", message)
+		t.Fail()
+	}
+}
+
+// Accepts a fixed set of raw tokens, standing in for Auth.
+type fakeVerifier map[string]*authclient.Claims
+
+func (v fakeVerifier) Verify(raw string) (*authclient.Claims, error) {
+	if claims, ok := v[raw]; ok {
+		return claims, nil
+	}
+	return nil, authclient.ErrInvalidToken
+}
+
+func TestStreamEventsWebSocketToken(t *testing.T) {
+	events = newEventLog(defaultEventLogSize)
+
+	verifier := fakeVerifier{
+		"dispatch-token": {ClientID: "dispatch", Scope: "roster:read"},
+		"driver-token":   {Username: "babydriver", Roles: []string{authclient.RoleDriver}},
+	}
+	server := httptest.NewServer(authclient.RequireScope(verifier, authclient.StreamToken, "roster:read")(http.HandlerFunc(streamEvents)))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// Browsers offer the token as a subprotocol, which the server must agree to. The dashboard is served
+	// from another origin, which the browser names in the handshake.
+	dialer := websocket.Dialer{Subprotocols: []string{authclient.BearerProtocol, "dispatch-token"}}
+	conn, _, err := dialer.Dial(wsURL, http.Header{"Origin": {"https://ops.example.com"}})
+	if err != nil || conn.Subprotocol() != authclient.BearerProtocol {
+		log.Printf("Failed to open event WebSocket with token as subprotocol : %v", err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	events.publish(rosterEvent{Type: eventJoined, Username: "babydriver"})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var e rosterEvent
+	if err := conn.ReadJSON(&e); err != nil || e.Type != eventJoined {
+		log.Printf("Failed to stream event over WebSocket opened with token, got %v", e)
+		t.Fail()
+	}
+
+	cases := []struct {
+		name   string
+		url    string
+		dialer *websocket.Dialer
+		status int
+	}{
+		{"no token", wsURL, websocket.DefaultDialer, http.StatusUnauthorized},
+		{"unknown token", wsURL, &websocket.Dialer{Subprotocols: []string{authclient.BearerProtocol, "forged"}}, http.StatusUnauthorized},
+		// The query is only read for Server-Sent Events, since a WebSocket can send the token as a subprotocol
+		{"token in query", wsURL + "?access_token=dispatch-token", websocket.DefaultDialer, http.StatusUnauthorized},
+		{"driver token", wsURL, &websocket.Dialer{Subprotocols: []string{authclient.BearerProtocol, "driver-token"}}, http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		conn, resp, err := c.dialer.Dial(c.url, nil)
+		if err == nil {
+			conn.Close()
+		}
+		if err == nil || resp == nil || resp.StatusCode != c.status {
+			log.Printf("Failed to refuse event WebSocket with %s", c.name)
+			t.Fail()
+		}
+	}
+}
+
+func TestStreamEventsQueryToken(t *testing.T) {
+	events = newEventLog(defaultEventLogSize)
+
+	verifier := fakeVerifier{"dispatch-token": {ClientID: "dispatch", Scope: "roster:read"}}
+	server := httptest.NewServer(authclient.RequireScope(verifier, authclient.StreamToken, "roster:read")(http.HandlerFunc(streamEvents)))
+	defer server.Close()
+
+	// EventSource cannot send headers, so it sends the token in the query and asks for text/event-stream
+	req, _ := http.NewRequest("GET", server.URL+"?access_token=dispatch-token", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		log.Println("Failed to open event stream with token in query")
+		t.Fail()
+	}
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	// Other requests must send the token in a header, so that it stays out of access logs
+	resp, err = http.Get(server.URL + "?access_token=dispatch-token")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to refuse token in query outside an event stream")
+		t.Fail()
+	}
+	if err == nil {
+		resp.Body.Close()
+	}
+}
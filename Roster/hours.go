@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
+)
+
+// Kinds of working time.
+const (
+	workOnRoster = "roster"
+	workOnTrip   = "trip"
+)
+
+// Working time is added up over this rolling window.
+const hoursWindow = 24 * time.Hour
+
+// Drivers are forced off the roster when either time in the window reaches its limit, and cannot
+// rejoin until the break is over. Overridden by MAX_ROSTER_TIME, MAX_TRIP_TIME and MANDATORY_BREAK.
+const defaultMaxRosterTime = 11 * time.Hour
+const defaultMaxTripTime = 10 * time.Hour
+const defaultMandatoryBreak = 10 * time.Hour
+
+var maxRosterTime = defaultMaxRosterTime
+var maxTripTime = defaultMaxTripTime
+var mandatoryBreak = defaultMandatoryBreak
+
+// A finished stretch of time on the roster or on a trip.
+type workPeriod struct {
+	Kind  string    `json:"kind"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// A driver's recent working time, and the end of any break they were sent on.
+type driverHours struct {
+	Periods    []workPeriod `json:"periods"`
+	BreakUntil time.Time    `json:"break_until"`
+}
+
+// Adds a finished period, forgetting any that ended before the window.
+func (h *driverHours) record(p workPeriod, now time.Time) {
+	kept := []workPeriod{}
+	for _, existing := range h.Periods {
+		if existing.End.After(now.Add(-hoursWindow)) {
+			kept = append(kept, existing)
+		}
+	}
+	if p.End.After(p.Start) {
+		kept = append(kept, p)
+	}
+	h.Periods = kept
+}
+
+// How much of start to end falls in the window ending at now.
+func timeInWindow(start, end, now time.Time) time.Duration {
+	if windowStart := now.Add(-hoursWindow); start.Before(windowStart) {
+		start = windowStart
+	}
+	if end.After(now) {
+		end = now
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// Adds up the time on the roster and on trips in the window ending at now. If the driver is in the roster,
+// pass their record so that the time since they joined, or since their trip started, is counted too.
+func (h driverHours) usage(d *driver, now time.Time) (onRoster, onTrip time.Duration) {
+	for _, p := range h.Periods {
+		switch p.Kind {
+		case workOnRoster:
+			onRoster += timeInWindow(p.Start, p.End, now)
+		case workOnTrip:
+			onTrip += timeInWindow(p.Start, p.End, now)
+		}
+	}
+
+	if d != nil && !d.JoinedAt.IsZero() {
+		onRoster += timeInWindow(d.JoinedAt, now, now)
+	}
+	if d != nil && d.TripStartedAt != nil {
+		onTrip += timeInWindow(*d.TripStartedAt, now, now)
+	}
+	return onRoster, onTrip
+}
+
+func overLimit(onRoster, onTrip time.Duration) bool {
+	return onRoster >= maxRosterTime || onTrip >= maxTripTime
+}
+
+// Adds a period to the driver's working time. Like recordRate, a failure is logged, since the driver
+// has already left or finished their trip by the time this is called.
+func recordWork(username, kind string, start, end time.Time) {
+	err := roster.UpdateHours(username, func(h *driverHours) {
+		h.record(workPeriod{Kind: kind, Start: start, End: end}, end)
+	})
+	if err != nil {
+		log.Printf("Error: Could not record %s time for user %s : %s", kind, username, err)
+	}
+}
+
+// Records the working time of a driver who has just left the roster.
+func recordLeave(d driver, now time.Time) {
+	if !d.JoinedAt.IsZero() {
+		recordWork(d.Username, workOnRoster, d.JoinedAt, now)
+	}
+	if d.TripStartedAt != nil {
+		recordWork(d.Username, workOnTrip, *d.TripStartedAt, now)
+	}
+}
+
+// Returns a message if the driver may not join the roster now, because they are on a mandatory break
+// or have already reached a limit.
+func checkHours(username string, now time.Time) (string, error) {
+	h, err := roster.Hours(username)
+	if err != nil {
+		return "", err
+	}
+
+	if now.Before(h.BreakUntil) {
+		return "On a mandatory break until " + h.BreakUntil.UTC().Format(time.RFC3339), nil
+	}
+	if overLimit(h.usage(nil, now)) {
+		return "Working hours limit reached", nil
+	}
+	return "", nil
+}
+
+var errOnTrip = errors.New("driver is on a trip")
+var errWithinHours = errors.New("driver is within working hours limits")
+
+// Forces drivers who have reached a limit off the roster and starts their mandatory break.
+// Drivers on a trip are left to finish it first.
+func enforceHoursLimits(now time.Time) {
+	drivers, err := roster.List()
+	if err != nil {
+		log.Printf("Error: Could not read roster to enforce working hours : %s", err)
+		return
+	}
+
+	for _, d := range drivers {
+		if d.State == stateOnTrip {
+			continue
+		}
+
+		h, err := roster.Hours(d.Username)
+		if err != nil {
+			log.Printf("Error: Could not read working hours of user %s : %s", d.Username, err)
+			continue
+		}
+
+		onRoster, onTrip := h.usage(&d, now)
+		if !overLimit(onRoster, onTrip) {
+			continue
+		}
+
+		// The list may be out of date by now, so the driver is checked again as they leave
+		left, err := roster.LeaveIf(d.Username, func(current driver) error {
+			if current.State == stateOnTrip {
+				return errOnTrip
+			}
+			onRoster, onTrip = h.usage(&current, now)
+			if !overLimit(onRoster, onTrip) {
+				return errWithinHours
+			}
+			return nil
+		})
+		if err == ErrNotInRoster || err == errOnTrip || err == errWithinHours {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error: Could not force user %s off the roster : %s", d.Username, err)
+			continue
+		}
+
+		locations.remove(left.Username)
+		recordLeave(left, now)
+		events.publish(rosterEvent{Type: eventLeft, Username: left.Username, At: now, Driver: &left, Reason: reasonHoursLimit})
+
+		err = roster.UpdateHours(left.Username, func(h *driverHours) {
+			h.BreakUntil = now.Add(mandatoryBreak)
+		})
+		if err != nil {
+			log.Printf("Error: Could not start mandatory break for user %s : %s", left.Username, err)
+		}
+
+		log.Printf("User %s reached the working hours limit (%s on roster, %s on trips) and was removed from roster.",
+			left.Username, onRoster.Round(time.Second), onTrip.Round(time.Second))
+	}
+}
+
+// Requires authentication as the driver themselves or an admin.
+// Shows how long the driver has spent on the roster and on trips in the last 24 hours, against the limits.
+func getHours(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	username := mux.Vars(r)["username"]
+	claims, _ := authclient.ClaimsFromContext(r.Context())
+
+	if claims.Username != username && !claims.HasRole(authclient.RoleAdmin) {
+		log.Printf("Error: User %s cannot read the working hours of %s", claims.Username, username)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("{\"error\": \"Insufficient permissions\"}"))
+		return
+	}
+
+	h, err := roster.Hours(username)
+	var current *driver
+	if err == nil {
+		var d driver
+		d, err = roster.Get(username)
+		if err == nil {
+			current = &d
+		} else if err == ErrNotInRoster {
+			err = nil
+		}
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not read working hours of user %s : %s", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not read working hours\"}"))
+		return
+	}
+
+	now := time.Now()
+	onRoster, onTrip := h.usage(current, now)
+
+	var breakUntil *time.Time
+	if now.Before(h.BreakUntil) {
+		breakUntil = &h.BreakUntil
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Username           string     `json:"username"`
+		OnRosterMinutes    int        `json:"on_roster_minutes"`
+		OnTripMinutes      int        `json:"on_trip_minutes"`
+		MaxOnRosterMinutes int        `json:"max_on_roster_minutes"`
+		MaxOnTripMinutes   int        `json:"max_on_trip_minutes"`
+		BreakUntil         *time.Time `json:"break_until,omitempty"`
+	}{username, int(onRoster.Minutes()), int(onTrip.Minutes()), int(maxRosterTime.Minutes()), int(maxTripTime.Minutes()), breakUntil})
+}
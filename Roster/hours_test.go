@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"testing"
+	"time"
+)
+
+func TestHoursUsage(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	tripStarted := now.Add(-30 * time.Minute)
+
+	h := driverHours{Periods: []workPeriod{
+		// Only the last two hours of this fall in the window
+		{Kind: workOnRoster, Start: now.Add(-26 * time.Hour), End: now.Add(-22 * time.Hour)},
+		{Kind: workOnTrip, Start: now.Add(-23 * time.Hour), End: now.Add(-22 * time.Hour)},
+		{Kind: workOnRoster, Start: now.Add(-10 * time.Hour), End: now.Add(-7 * time.Hour)},
+	}}
+	d := driver{Username: "sebvet", JoinedAt: now.Add(-time.Hour), TripStartedAt: &tripStarted}
+
+	onRoster, onTrip := h.usage(&d, now)
+	if onRoster != 6*time.Hour || onTrip != 90*time.Minute {
+		log.Printf("Failed to add up working time, got %s on roster and %s on trips", onRoster, onTrip)
+		t.Fail()
+	}
+
+	if onRoster, _ := h.usage(nil, now); onRoster != 5*time.Hour {
+		log.Printf("Failed to add up working time off the roster, got %s", onRoster)
+		t.Fail()
+	}
+
+	// Recording drops periods that have left the window
+	h.record(workPeriod{Kind: workOnTrip, Start: now.Add(-time.Hour), End: now}, now.Add(3*time.Hour))
+	if len(h.Periods) != 2 {
+		log.Printf("Failed to forget old working time, got %v", h.Periods)
+		t.Fail()
+	}
+}
+
+func TestEnforceHoursLimits(t *testing.T) {
+	roster = newMemoryRosterStore()
+	now := time.Now()
+	tripStarted := now.Add(-time.Hour)
+
+	roster.Join(driver{Username: "sebvet", Rate: 5, State: stateAvailable, JoinedAt: now.Add(-maxRosterTime)})
+	roster.Join(driver{Username: "babydriver", Rate: 5, State: stateOnTrip, JoinedAt: now.Add(-maxRosterTime), TripStartedAt: &tripStarted})
+	roster.Join(driver{Username: "walker", Rate: 5, State: stateAvailable, JoinedAt: now.Add(-time.Hour)})
+
+	enforceHoursLimits(now)
+
+	if _, err := roster.Get("sebvet"); err != ErrNotInRoster {
+		log.Println("Failed to force driver over the limit off the roster")
+		t.Fail()
+	}
+
+	// Drivers on a trip finish it first
+	for _, username := range []string{"babydriver", "walker"} {
+		if _, err := roster.Get(username); err != nil {
+			log.Printf("Failed to keep %s on the roster", username)
+			t.Fail()
+		}
+	}
+
+	h, _ := roster.Hours("sebvet")
+	if onRoster, _ := h.usage(nil, now); onRoster != maxRosterTime || !h.BreakUntil.Equal(now.Add(mandatoryBreak)) {
+		log.Printf("Failed to record working time and start break, got %v", h)
+		t.Fail()
+	}
+
+	if problem, _ := checkHours("sebvet", now.Add(mandatoryBreak-time.Minute)); problem == "" {
+		log.Println("Failed to stop driver rejoining during their break")
+		t.Fail()
+	}
+
+	// By the end of the break, the time on the roster has left the window too
+	if problem, _ := checkHours("sebvet", now.Add(hoursWindow)); problem != "" {
+		log.Printf("Failed to let driver rejoin after their break : %s", problem)
+		t.Fail()
+	}
+}
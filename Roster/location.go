@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Positions not updated for this long are treated as unknown and then pruned. Overridden by LOCATION_TTL.
+const defaultLocationTTL = 2 * time.Minute
+
+// Reports may be slightly ahead of our clock. Anything further ahead is refused.
+const maxLocationClockSkew = time.Minute
+
+const defaultNearbyRadius = 5.0
+const maxNearbyRadius = 50.0
+
+// Positions are bucketed by geohash prefix. Five characters gives cells of roughly 5km by 5km in the UK,
+// so a search only has to look at a few hundred cells at the largest radius.
+const geohashPrecision = 5
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+const earthRadiusKm = 6371.0
+const kmPerDegreeLat = 111.32
+
+var errStaleLocation = errors.New("location is older than the last one reported")
+
+// Live driver positions, held in memory only. Positions are reported every few seconds,
+// so there is nothing worth keeping across a restart.
+var locations = newLocationIndex(defaultLocationTTL)
+
+type position struct {
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// The body of PUT /roster/location. Timestamp defaults to the time the request arrives.
+type locationRequest struct {
+	Lat       *float64   `json:"lat"`
+	Lng       *float64   `json:"lng"`
+	Timestamp *time.Time `json:"timestamp"`
+}
+
+type nearbyDriver struct {
+	driver
+	Location position `json:"location"`
+	Distance float64  `json:"distance_km"`
+}
+
+// Encodes a point as a geohash of the given length.
+// Bits alternate between longitude and latitude, each halving the remaining range.
+func geohash(lat, lng float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+
+	hash := make([]byte, 0, precision)
+	bit, value, even := 0, 0, true
+	for len(hash) < precision {
+		r, v := &latRange, lat
+		if even {
+			r, v = &lngRange, lng
+		}
+
+		mid := (r[0] + r[1]) / 2
+		value <<= 1
+		if v >= mid {
+			value |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+
+		if bit++; bit == 5 {
+			hash = append(hash, geohashAlphabet[value])
+			bit, value = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// Size in degrees of a geohash cell of the given length.
+func geohashCellSize(precision int) (lat, lng float64) {
+	bits := precision * 5
+	lngBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lngBits))
+}
+
+// Great-circle distance between two points in kilometres.
+func haversine(lat1, lng1, lat2, lng2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+
+	dLat := toRadians(lat2 - lat1)
+	dLng := toRadians(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// Driver positions indexed by geohash cell. It is safe for concurrent use.
+type locationIndex struct {
+	ttl time.Duration
+
+	mutex     sync.RWMutex
+	positions map[string]position
+	// Geohash cell to the usernames of the drivers last seen in it.
+	cells map[string]map[string]bool
+}
+
+func newLocationIndex(ttl time.Duration) *locationIndex {
+	return &locationIndex{
+		ttl:       ttl,
+		positions: map[string]position{},
+		cells:     map[string]map[string]bool{},
+	}
+}
+
+// Records the driver's position. Reports older than the one already held are refused with errStaleLocation,
+// since they can arrive out of order over a mobile connection.
+func (l *locationIndex) update(username string, p position) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if previous, ok := l.positions[username]; ok {
+		if p.Timestamp.Before(previous.Timestamp) {
+			return errStaleLocation
+		}
+		l.removeLocked(username)
+	}
+
+	cell := geohash(p.Lat, p.Lng, geohashPrecision)
+	if l.cells[cell] == nil {
+		l.cells[cell] = map[string]bool{}
+	}
+	l.cells[cell][username] = true
+	l.positions[username] = p
+	return nil
+}
+
+func (l *locationIndex) remove(username string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.removeLocked(username)
+}
+
+func (l *locationIndex) removeLocked(username string) {
+	p, ok := l.positions[username]
+	if !ok {
+		return
+	}
+
+	cell := geohash(p.Lat, p.Lng, geohashPrecision)
+	delete(l.cells[cell], username)
+	if len(l.cells[cell]) == 0 {
+		delete(l.cells, cell)
+	}
+	delete(l.positions, username)
+}
+
+type nearbyPosition struct {
+	Username string
+	position
+	Distance float64
+}
+
+// Returns the fresh positions within radius kilometres of the point, nearest first.
+func (l *locationIndex) nearby(lat, lng, radius float64) []nearbyPosition {
+	// Bounding box of the search circle. Longitude degrees shrink towards the poles.
+	dLat := radius / kmPerDegreeLat
+	dLng := radius / (kmPerDegreeLat * math.Max(math.Cos(lat*math.Pi/180), 0.01))
+	minLat, maxLat := math.Max(lat-dLat, -90), math.Min(lat+dLat, 90)
+	minLng, maxLng := math.Max(lng-dLng, -180), math.Min(lng+dLng, 180)
+
+	// Cells are aligned to multiples of their size, so stepping by one cell visits every cell in the box.
+	latStep, lngStep := geohashCellSize(geohashPrecision)
+	cells := map[string]bool{}
+	for y := minLat; y < maxLat+latStep; y += latStep {
+		for x := minLng; x < maxLng+lngStep; x += lngStep {
+			cells[geohash(math.Min(y, maxLat), math.Min(x, maxLng), geohashPrecision)] = true
+		}
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	cutoff := time.Now().Add(-l.ttl)
+	var matches []nearbyPosition
+	for cell := range cells {
+		for username := range l.cells[cell] {
+			p := l.positions[username]
+			if p.Timestamp.Before(cutoff) {
+				continue
+			}
+			if distance := haversine(lat, lng, p.Lat, p.Lng); distance <= radius {
+				matches = append(matches, nearbyPosition{Username: username, position: p, Distance: distance})
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Distance < matches[j].Distance })
+	return matches
+}
+
+// Drops positions that have not been updated within the TTL.
+func (l *locationIndex) pruneEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.mutex.Lock()
+		cutoff := time.Now().Add(-l.ttl)
+		for username, p := range l.positions {
+			if p.Timestamp.Before(cutoff) {
+				l.removeLocked(username)
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// Requires authentication as a driver who is in the roster.
+func updateLocation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Printf("Error: Parsing request to update location failed : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Parsing request to update location failed\"}"))
+		return
+	}
+
+	var requestData locationRequest
+	err = json.Unmarshal(body, &requestData)
+
+	if err != nil || requestData.Lat == nil || requestData.Lng == nil {
+		log.Println("Error: Request is missing lat or lng")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Request is missing lat or lng\"}"))
+		return
+	}
+
+	p := position{Lat: *requestData.Lat, Lng: *requestData.Lng, Timestamp: time.Now()}
+	if requestData.Timestamp != nil {
+		p.Timestamp = *requestData.Timestamp
+	}
+
+	if p.Lat < -90 || p.Lat > 90 || p.Lng < -180 || p.Lng > 180 {
+		log.Println("Error: Invalid location supplied.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Invalid location supplied\"}"))
+		return
+	}
+
+	if p.Timestamp.After(time.Now().Add(maxLocationClockSkew)) || time.Since(p.Timestamp) > locations.ttl {
+		log.Printf("Error: Location timestamp %s is out of range.", p.Timestamp)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Location timestamp is too far from the current time\"}"))
+		return
+	}
+
+	user := authenticatedDriver(r)
+
+	// Only drivers in the roster can be found, so there is no point tracking anyone else
+	if _, err := roster.Get(user.Username); err != nil {
+		log.Println("Error: User is not in roster.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"User is not in roster\"}"))
+		return
+	}
+
+	if err := locations.update(user.Username, p); err != nil {
+		log.Printf("Error: Location for user %s is older than the last one reported.", user.Username)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("{\"error\": \"Location is older than the last one reported\"}"))
+		return
+	}
+
+	events.publish(rosterEvent{Type: eventLocationUpdated, Username: user.Username, Location: &p})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(p)
+}
+
+// Parses an optional float query parameter, returning fallback if it is absent.
+func queryFloat(r *http.Request, name string, fallback float64) (float64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// Requires a service token with the roster:read scope.
+// Lists the available drivers in the roster within radius kilometres of lat and lng, nearest first,
+// with the rates their rate profiles give now. Takes the same pickup parameters as getDrivers.
+func nearbyDrivers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	lat, latErr := queryFloat(r, "lat", math.NaN())
+	lng, lngErr := queryFloat(r, "lng", math.NaN())
+	radius, radiusErr := queryFloat(r, "radius", defaultNearbyRadius)
+
+	if latErr != nil || lngErr != nil || math.IsNaN(lat) || math.IsNaN(lng) || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		log.Println("Error: Nearby search is missing a valid lat or lng")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"A valid lat and lng are required\"}"))
+		return
+	}
+
+	if radiusErr != nil || radius <= 0 || radius > maxNearbyRadius {
+		log.Println("Error: Invalid radius supplied for nearby search")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Radius must be more than 0 and at most 50km\"}"))
+		return
+	}
+
+	filter, problem := parseVehicleFilter(r)
+
+	if problem != "" {
+		log.Printf("Error: Invalid vehicle filter : %s", problem)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"" + problem + "\"}"))
+		return
+	}
+
+	pickup, problem := parsePickup(r, "pickup_")
+
+	if problem != "" {
+		log.Printf("Error: Invalid pickup : %s", problem)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"" + problem + "\"}"))
+		return
+	}
+
+	now := time.Now()
+	drivers := []nearbyDriver{}
+	for _, match := range locations.nearby(lat, lng, radius) {
+		d, err := roster.Get(match.Username)
+
+		// Drivers who left since their last report are not available
+		if err == ErrNotInRoster {
+			continue
+		}
+
+		if err != nil {
+			log.Printf("Error: Could not read roster : %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("{\"error\": \"Could not read roster\"}"))
+			return
+		}
+
+		if d.State != stateAvailable || !filter.matches(d) {
+			continue
+		}
+
+		if pickup.given() {
+			served, err := pickup.servedBy(d.Username)
+
+			if err != nil {
+				log.Printf("Error: Could not read operating area of user %s : %s", d.Username, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("{\"error\": \"Could not read roster\"}"))
+				return
+			}
+
+			if !served {
+				continue
+			}
+		}
+
+		profile, err := roster.RateProfile(d.Username)
+
+		if err != nil {
+			log.Printf("Error: Could not read rate profile of user %s : %s", d.Username, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("{\"error\": \"Could not read roster\"}"))
+			return
+		}
+		d.Rate = profile.rateAt(now, d.Rate)
+
+		drivers = append(drivers, nearbyDriver{
+			driver:   d,
+			Location: match.position,
+			Distance: math.Round(match.Distance*1000) / 1000,
+		})
+	}
+
+	log.Printf("Found %d drivers within %.1fkm of %f,%f", len(drivers), radius, lat, lng)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(drivers)
+}
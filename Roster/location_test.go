@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"testing"
+	"time"
+)
+
+func TestGeohash(t *testing.T) {
+	// Example from the geohash specification
+	if hash := geohash(57.64911, 10.40744, 11); hash != "u4pruydqqvj" {
+		log.Printf("Failed to encode geohash, got %s", hash)
+		t.Fail()
+	}
+}
+
+func TestLocationIndexNearby(t *testing.T) {
+	index := newLocationIndex(time.Minute)
+	now := time.Now()
+
+	// Trafalgar Square, Waterloo station, Heathrow and Manchester Piccadilly
+	index.update("trafalgar", position{Lat: 51.5080, Lng: -0.1281, Timestamp: now})
+	index.update("waterloo", position{Lat: 51.5031, Lng: -0.1132, Timestamp: now})
+	index.update("heathrow", position{Lat: 51.4700, Lng: -0.4543, Timestamp: now})
+	index.update("manchester", position{Lat: 53.4774, Lng: -2.2309, Timestamp: now})
+
+	// Search from Westminster Bridge
+	matches := index.nearby(51.5008, -0.1219, 5)
+
+	if len(matches) != 2 || matches[0].Username != "waterloo" || matches[1].Username != "trafalgar" {
+		log.Printf("Failed to find nearby drivers in distance order, got %v", matches)
+		t.Fail()
+	}
+
+	// Heathrow is about 23km away, several cells over
+	if matches := index.nearby(51.5008, -0.1219, 25); len(matches) != 3 || matches[2].Username != "heathrow" {
+		log.Printf("Failed to search across geohash cells, got %v", matches)
+		t.Fail()
+	}
+
+	// A driver who moves is only found at their new position
+	index.update("manchester", position{Lat: 51.5010, Lng: -0.1220, Timestamp: now.Add(time.Second)})
+	if matches := index.nearby(51.5008, -0.1219, 5); len(matches) != 3 || matches[0].Username != "manchester" {
+		log.Printf("Failed to move driver in index, got %v", matches)
+		t.Fail()
+	}
+	if matches := index.nearby(53.4774, -2.2309, 5); len(matches) != 0 {
+		log.Printf("Failed to remove driver from old cell, got %v", matches)
+		t.Fail()
+	}
+
+	// Out of order reports are refused
+	if err := index.update("manchester", position{Lat: 53.4774, Lng: -2.2309, Timestamp: now}); err != errStaleLocation {
+		log.Println("Failed to refuse location older than the last one reported")
+		t.Fail()
+	}
+}
+
+func TestLocationIndexExpiry(t *testing.T) {
+	index := newLocationIndex(time.Minute)
+
+	index.update("stale", position{Lat: 51.5080, Lng: -0.1281, Timestamp: time.Now().Add(-2 * time.Minute)})
+	index.update("fresh", position{Lat: 51.5031, Lng: -0.1132, Timestamp: time.Now()})
+
+	matches := index.nearby(51.5008, -0.1219, 5)
+
+	if len(matches) != 1 || matches[0].Username != "fresh" {
+		log.Printf("Failed to ignore stale location, got %v", matches)
+		t.Fail()
+	}
+}
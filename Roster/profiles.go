@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matt-drayton/easy-ride/Shared/ukclock"
+)
+
+const maxProfileWindows = 50
+const maxProfileOverrides = 100
+
+// Profile times are wall clock times in the UK, so a 07:00 rush hour starts at 07:00 in both GMT and BST.
+var rateLocation = ukclock.Location
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// A rate that applies on some days of every week between two times. Windows cannot cross midnight,
+// so a late night rate is two windows, ending at "24:00" and starting at "00:00".
+type rateWindow struct {
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	Rate  int      `json:"rate"`
+}
+
+// A rate for a particular date, such as Christmas Day. Without a start and end it lasts all day.
+type rateOverride struct {
+	Date  string `json:"date"`
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	Rate  int    `json:"rate"`
+}
+
+// How a driver's rate varies through the week. Overrides win over weekly windows, and the driver's
+// flat rate applies whenever neither covers the time.
+type rateProfile struct {
+	Weekly    []rateWindow   `json:"weekly"`
+	Overrides []rateOverride `json:"overrides"`
+}
+
+// Parses "HH:MM" into minutes since midnight. "24:00" is allowed so that a window can end at midnight.
+func clockMinutes(clock string) (int, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 || len(parts[0]) != 2 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	return hours*60 + minutes, nil
+}
+
+// Minutes since midnight covered by start and end. An empty start and end covers the whole day.
+func windowMinutes(start, end string) (int, int, error) {
+	if start == "" && end == "" {
+		return 0, 24 * 60, nil
+	}
+	from, err := clockMinutes(start)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := clockMinutes(end)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from >= to {
+		return 0, 0, fmt.Errorf("start %s is not before end %s", start, end)
+	}
+	return from, to, nil
+}
+
+type minuteRange struct{ from, to int }
+
+// Reports whether any two of the ranges overlap.
+func overlapping(ranges []minuteRange) bool {
+	for i := range ranges {
+		for j := i + 1; j < len(ranges); j++ {
+			if ranges[i].from < ranges[j].to && ranges[j].from < ranges[i].to {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns a message for the first problem with the profile, or "" if it is valid.
+func validateProfile(p rateProfile) string {
+	if len(p.Weekly) > maxProfileWindows || len(p.Overrides) > maxProfileOverrides {
+		return "Profiles can have at most 50 weekly windows and 100 overrides"
+	}
+
+	byDay := map[string][]minuteRange{}
+	for _, window := range p.Weekly {
+		from, to, err := windowMinutes(window.Start, window.End)
+		if err != nil || window.Start == "" {
+			return "Weekly windows need a start and end time, HH:MM, with start before end"
+		}
+		if window.Rate <= 0 {
+			return "Invalid rate value supplied"
+		}
+		if len(window.Days) == 0 {
+			return "Weekly windows need at least one day"
+		}
+		for _, day := range window.Days {
+			if !validWeekday(day) {
+				return "Days must be from mon, tue, wed, thu, fri, sat and sun"
+			}
+			byDay[day] = append(byDay[day], minuteRange{from, to})
+		}
+	}
+	for _, ranges := range byDay {
+		if overlapping(ranges) {
+			return "Weekly windows cannot overlap"
+		}
+	}
+
+	byDate := map[string][]minuteRange{}
+	for _, override := range p.Overrides {
+		if _, err := time.Parse("2006-01-02", override.Date); err != nil {
+			return "Override dates must be YYYY-MM-DD"
+		}
+		from, to, err := windowMinutes(override.Start, override.End)
+		if err != nil {
+			return "Override times must be HH:MM, with start before end, or left out for the whole day"
+		}
+		if override.Rate <= 0 {
+			return "Invalid rate value supplied"
+		}
+		byDate[override.Date] = append(byDate[override.Date], minuteRange{from, to})
+	}
+	for _, ranges := range byDate {
+		if overlapping(ranges) {
+			return "Overrides on the same date cannot overlap"
+		}
+	}
+	return ""
+}
+
+func validWeekday(day string) bool {
+	for _, d := range weekdays {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+func coversMinute(start, end string, minute int) bool {
+	from, to, err := windowMinutes(start, end)
+	return err == nil && from <= minute && minute < to
+}
+
+// Works out the rate the profile gives at t, falling back to the flat rate.
+func (p rateProfile) rateAt(t time.Time, flatRate int) int {
+	local := t.In(rateLocation)
+	minute := local.Hour()*60 + local.Minute()
+
+	date := local.Format("2006-01-02")
+	for _, override := range p.Overrides {
+		if override.Date == date && coversMinute(override.Start, override.End, minute) {
+			return override.Rate
+		}
+	}
+
+	day := weekdays[local.Weekday()]
+	for _, window := range p.Weekly {
+		for _, d := range window.Days {
+			if d == day && coversMinute(window.Start, window.End, minute) {
+				return window.Rate
+			}
+		}
+	}
+	return flatRate
+}
+
+// Replaces each driver's flat rate with the rate their profile gives at t.
+func applyRateProfiles(drivers []driver, t time.Time) error {
+	for i := range drivers {
+		profile, err := roster.RateProfile(drivers[i].Username)
+		if err != nil {
+			return err
+		}
+		drivers[i].Rate = profile.rateAt(t, drivers[i].Rate)
+	}
+	return nil
+}
+
+// Parses the optional "at" query parameter, defaulting to now.
+func queryTime(r *http.Request) (time.Time, error) {
+	value := r.URL.Query().Get("at")
+	if value == "" {
+		return time.Now(), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Requires authentication as a driver. Returns their rate profile, which is empty if they have not set one.
+func getRateProfile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := authenticatedDriver(r)
+
+	profile, err := roster.RateProfile(user.Username)
+
+	if err != nil {
+		log.Printf("Error: Could not read rate profile of user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not read rate profile\"}"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
+}
+
+// Requires authentication as a driver. Replaces their rate profile. Sending an empty profile
+// goes back to the flat rate at all times.
+func setRateProfile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Printf("Error: Parsing request to set rate profile failed : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Parsing request to set rate profile failed\"}"))
+		return
+	}
+
+	var profile rateProfile
+	if err := json.Unmarshal(body, &profile); err != nil {
+		log.Printf("Error: Invalid rate profile supplied : %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Invalid rate profile supplied\"}"))
+		return
+	}
+
+	if profile.Weekly == nil {
+		profile.Weekly = []rateWindow{}
+	}
+	if profile.Overrides == nil {
+		profile.Overrides = []rateOverride{}
+	}
+
+	if problem := validateProfile(profile); problem != "" {
+		log.Printf("Error: Invalid rate profile supplied : %s", problem)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"" + problem + "\"}"))
+		return
+	}
+
+	user := authenticatedDriver(r)
+
+	if err := roster.SetRateProfile(user.Username, profile); err != nil {
+		log.Printf("Error: Could not save rate profile of user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not save rate profile\"}"))
+		return
+	}
+
+	// The flat rate is unchanged, so it is the last one in the history
+	now := time.Now()
+	change := rateChange{EffectiveAt: now, Reason: rateProfileChanged, Profile: &profile}
+	if history, err := roster.RateHistory(user.Username); err == nil && len(history) > 0 {
+		change.Rate = history[len(history)-1].Rate
+	}
+	recordRate(user.Username, change)
+
+	// Drivers in the roster may now be offered at different rates
+	if d, err := roster.Get(user.Username); err == nil {
+		events.publish(rosterEvent{Type: eventRateChanged, Username: user.Username, At: now, Driver: &d, Reason: rateProfileChanged})
+	}
+
+	log.Printf("Rate profile updated for user %s.", user.Username)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"testing"
+	"time"
+)
+
+func TestRateProfileRateAt(t *testing.T) {
+	profile := rateProfile{
+		Weekly: []rateWindow{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "07:00", End: "10:00", Rate: 9},
+			{Days: []string{"sat"}, Start: "22:00", End: "24:00", Rate: 12},
+		},
+		Overrides: []rateOverride{
+			{Date: "2021-12-25", Rate: 20},
+			{Date: "2021-12-31", Start: "20:00", End: "24:00", Rate: 25},
+		},
+	}
+
+	cases := []struct {
+		at   string
+		rate int
+	}{
+		// Monday in winter, when London is on UTC
+		{"2021-01-04T07:30:00Z", 9},
+		{"2021-01-04T10:00:00Z", 5},
+		// Monday in summer, when 06:30 UTC is 07:30 in London
+		{"2021-07-05T06:30:00Z", 9},
+		{"2021-07-05T09:30:00Z", 5},
+		// Late on Saturday, up to midnight
+		{"2021-01-09T23:59:00Z", 12},
+		{"2021-01-10T00:00:00Z", 5},
+		// Christmas Day is a Saturday, and the override covers the whole day
+		{"2021-12-25T23:00:00Z", 20},
+		// New Year's Eve is a Friday, with rush hour in the morning and the override in the evening
+		{"2021-12-31T08:00:00Z", 9},
+		{"2021-12-31T21:00:00Z", 25},
+	}
+
+	for _, c := range cases {
+		at, _ := time.Parse(time.RFC3339, c.at)
+		if rate := profile.rateAt(at, 5); rate != c.rate {
+			log.Printf("Failed to resolve rate at %s, got %dp not %dp", c.at, rate, c.rate)
+			t.Fail()
+		}
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	cases := []struct {
+		name    string
+		profile rateProfile
+		valid   bool
+	}{
+		{"empty", rateProfile{}, true},
+		{"adjacent windows", rateProfile{Weekly: []rateWindow{
+			{Days: []string{"mon"}, Start: "07:00", End: "10:00", Rate: 9},
+			{Days: []string{"mon"}, Start: "10:00", End: "12:00", Rate: 7},
+		}}, true},
+		{"overlapping windows", rateProfile{Weekly: []rateWindow{
+			{Days: []string{"mon", "tue"}, Start: "07:00", End: "10:00", Rate: 9},
+			{Days: []string{"tue"}, Start: "09:00", End: "12:00", Rate: 7},
+		}}, false},
+		{"window across midnight", rateProfile{Weekly: []rateWindow{{Days: []string{"fri"}, Start: "22:00", End: "02:00", Rate: 9}}}, false},
+		{"unknown day", rateProfile{Weekly: []rateWindow{{Days: []string{"monday"}, Start: "07:00", End: "10:00", Rate: 9}}}, false},
+		{"invalid time", rateProfile{Weekly: []rateWindow{{Days: []string{"mon"}, Start: "7:00", End: "10:00", Rate: 9}}}, false},
+		{"free window", rateProfile{Weekly: []rateWindow{{Days: []string{"mon"}, Start: "07:00", End: "10:00", Rate: 0}}}, false},
+		{"overlapping overrides", rateProfile{Overrides: []rateOverride{
+			{Date: "2021-12-25", Rate: 20},
+			{Date: "2021-12-25", Start: "18:00", End: "20:00", Rate: 25},
+		}}, false},
+		{"invalid date", rateProfile{Overrides: []rateOverride{{Date: "25/12/2021", Rate: 20}}}, false},
+	}
+
+	for _, c := range cases {
+		if problem := validateProfile(c.profile); (problem == "") != c.valid {
+			log.Printf("Failed to validate %s profile, got %q", c.name, problem)
+			t.Fail()
+		}
+	}
+}
+
+func TestSetRateProfileRecordsHistory(t *testing.T) {
+	roster = newMemoryRosterStore()
+	events = newEventLog(defaultEventLogSize)
+	_, live, cancel := events.subscribe("")
+	defer cancel()
+
+	start := time.Now().Add(-time.Hour)
+	roster.Join(driver{Username: "sebvet", Rate: 5, State: stateAvailable})
+	roster.RecordRate("sebvet", rateChange{Rate: 5, EffectiveAt: start, Reason: rateJoined})
+
+	profile := "{\"weekly\": [{\"days\": [\"sat\"], \"start\": \"18:00\", \"end\": \"24:00\", \"rate\": 12}]}"
+	if code := driverRequest(setRateProfile, "PUT", "sebvet", profile); code != 200 {
+		log.Printf("Failed to set rate profile, got %d", code)
+		t.FailNow()
+	}
+
+	history, _ := roster.RateHistory("sebvet")
+	if len(history) != 2 || history[1].Reason != rateProfileChanged || history[1].Rate != 5 ||
+		history[1].Profile == nil || len(history[1].Profile.Weekly) != 1 {
+		log.Printf("Failed to record rate profile in history, got %v", history)
+		t.Fail()
+	}
+
+	select {
+	case e := <-live:
+		if e.Type != eventRateChanged || e.Reason != rateProfileChanged || e.Username != "sebvet" {
+			log.Printf("Failed to publish rate profile change, got %v", e)
+			t.Fail()
+		}
+	default:
+		log.Println("Failed to publish rate profile change")
+		t.Fail()
+	}
+
+	// A later flat rate change does not hide the profile that was in force before it
+	roster.RecordRate("sebvet", rateChange{Rate: 6, EffectiveAt: time.Now().Add(time.Minute), Reason: rateChanged})
+	history, _ = roster.RateHistory("sebvet")
+
+	inForce := changesSince(history, time.Now().Add(2*time.Minute))
+	if len(inForce) != 2 || inForce[0].Reason != rateProfileChanged || inForce[1].Rate != 6 {
+		log.Printf("Failed to include rate profile in force, got %v", inForce)
+		t.Fail()
+	}
+
+	if before := changesSince(history, start.Add(time.Second)); len(before) != 3 || before[0].Reason != rateJoined {
+		log.Printf("Failed to include changes after since, got %v", before)
+		t.Fail()
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
+)
+
+// Why a driver's rate changed.
+const (
+	rateJoined         = "joined"
+	rateChanged        = "changed"
+	rateScheduled      = "scheduled"
+	rateProfileChanged = "profile_changed"
+)
+
+// Scheduled changes can be set up to a year ahead, and a driver can have this many waiting at once.
+const maxScheduleAhead = 365 * 24 * time.Hour
+const maxScheduledRates = 20
+
+// One entry in a driver's rate history.
+type rateChange struct {
+	Rate        int       `json:"rate"`
+	EffectiveAt time.Time `json:"effective_at"`
+	Reason      string    `json:"reason"`
+	// Set when the change was made by the scheduler.
+	ScheduleID string `json:"schedule_id,omitempty"`
+	// Set when the driver replaced their rate profile. Rate is then the flat rate they had at the time.
+	Profile *rateProfile `json:"profile,omitempty"`
+}
+
+// A rate change waiting to be applied by the scheduler.
+type scheduledRate struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Rate     int       `json:"rate"`
+	At       time.Time `json:"at"`
+}
+
+type scheduleRateRequest struct {
+	Rate int       `json:"rate"`
+	At   time.Time `json:"at"`
+}
+
+func newScheduleID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Adds an entry to the driver's rate history. The rate has already changed by the time this is called,
+// so a failure is logged rather than passed back to the driver.
+func recordRate(username string, change rateChange) {
+	if err := roster.RecordRate(username, change); err != nil {
+		log.Printf("Error: Could not record rate %dp for user %s in history : %s", change.Rate, username, err)
+	}
+}
+
+// Requires authentication as the driver themselves or an admin.
+// Lists the driver's rate history, optionally between since and until, and any changes still scheduled.
+func getRateHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	username := mux.Vars(r)["username"]
+	claims, _ := authclient.ClaimsFromContext(r.Context())
+
+	if claims.Username != username && !claims.HasRole(authclient.RoleAdmin) {
+		log.Printf("Error: User %s cannot read the rate history of %s", claims.Username, username)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("{\"error\": \"Insufficient permissions\"}"))
+		return
+	}
+
+	query := r.URL.Query()
+	var since, until time.Time
+	var err error
+	if value := query.Get("since"); value != "" {
+		since, err = time.Parse(time.RFC3339, value)
+	}
+	if value := query.Get("until"); value != "" && err == nil {
+		until, err = time.Parse(time.RFC3339, value)
+	}
+
+	if err != nil {
+		log.Printf("Error: Invalid rate history time range : %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"since and until must be RFC 3339 times\"}"))
+		return
+	}
+
+	history, err := roster.RateHistory(username)
+	var scheduled []scheduledRate
+	if err == nil {
+		scheduled, err = roster.ScheduledRates(username)
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not read rate history of user %s : %s", username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not read rate history\"}"))
+		return
+	}
+
+	matches := []rateChange{}
+	for _, change := range history {
+		if !until.IsZero() && change.EffectiveAt.After(until) {
+			break
+		}
+		matches = append(matches, change)
+	}
+	if !since.IsZero() {
+		matches = changesSince(matches, since)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Username  string          `json:"username"`
+		History   []rateChange    `json:"history"`
+		Scheduled []scheduledRate `json:"scheduled"`
+	}{username, matches, scheduled})
+}
+
+// Returns the changes in history after since, plus those in force at it: the last flat rate set before it,
+// and the last rate profile set before it, since the profile decides the rate whenever one of its windows applies.
+func changesSince(history []rateChange, since time.Time) []rateChange {
+	lastRate, lastProfile := -1, -1
+	for i, change := range history {
+		if change.EffectiveAt.After(since) {
+			break
+		}
+		if change.Profile != nil {
+			lastProfile = i
+		} else {
+			lastRate = i
+		}
+	}
+
+	matches := []rateChange{}
+	for i, change := range history {
+		if i == lastRate || i == lastProfile || change.EffectiveAt.After(since) {
+			matches = append(matches, change)
+		}
+	}
+	return matches
+}
+
+// Requires authentication as a driver. Lists the driver's scheduled rate changes, soonest first.
+func listScheduledRates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := authenticatedDriver(r)
+
+	scheduled, err := roster.ScheduledRates(user.Username)
+
+	if err != nil {
+		log.Printf("Error: Could not read scheduled rates of user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not read scheduled rates\"}"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(scheduled)
+}
+
+// Requires authentication as a driver. Schedules the driver's rate to change at a future time.
+// The change is applied if the driver is in the roster at that time, and dropped otherwise.
+func scheduleRate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Printf("Error: Parsing request to schedule rate failed : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Parsing request to schedule rate failed\"}"))
+		return
+	}
+
+	var requestData scheduleRateRequest
+	err = json.Unmarshal(body, &requestData)
+
+	if err != nil || requestData.At.IsZero() {
+		log.Println("Error: Request is missing rate or at")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Request is missing rate or at\"}"))
+		return
+	}
+
+	// Cannot have a rate of less than or equal to 0p.
+	if requestData.Rate <= 0 {
+		log.Println("Error: Invalid rate value supplied.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Invalid rate value supplied\"}"))
+		return
+	}
+
+	if !requestData.At.After(time.Now()) || time.Until(requestData.At) > maxScheduleAhead {
+		log.Printf("Error: Scheduled rate time %s is out of range.", requestData.At)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Scheduled time must be in the next year\"}"))
+		return
+	}
+
+	user := authenticatedDriver(r)
+
+	scheduled, err := roster.ScheduledRates(user.Username)
+
+	if err == nil && len(scheduled) >= maxScheduledRates {
+		log.Printf("Error: User %s has too many scheduled rate changes.", user.Username)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("{\"error\": \"Too many scheduled rate changes\"}"))
+		return
+	}
+
+	change := scheduledRate{Username: user.Username, Rate: requestData.Rate, At: requestData.At.UTC()}
+	if err == nil {
+		change.ID, err = newScheduleID()
+	}
+	if err == nil {
+		err = roster.ScheduleRate(change)
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not schedule rate for user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not schedule rate\"}"))
+		return
+	}
+
+	log.Printf("Rate of %dp scheduled for user %s at %s", change.Rate, change.Username, change.At)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(change)
+}
+
+// Requires authentication as a driver. Cancels one of the driver's scheduled rate changes.
+func cancelScheduledRate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user := authenticatedDriver(r)
+	id := mux.Vars(r)["id"]
+
+	err := roster.CancelScheduledRate(user.Username, id)
+
+	if err == ErrScheduleNotFound {
+		log.Printf("Error: User %s has no scheduled rate %s", user.Username, id)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{\"error\": \"Scheduled rate not found\"}"))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not cancel scheduled rate for user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not cancel scheduled rate\"}"))
+		return
+	}
+
+	log.Printf("User %s cancelled scheduled rate %s.", user.Username, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Applies the scheduled rate changes that are due. Each change is taken out of the store before it is applied,
+// so it is applied at most once.
+func applyDueRates(now time.Time) {
+	due, err := roster.TakeDueRates(now)
+	if err != nil {
+		log.Printf("Error: Could not read scheduled rates : %s", err)
+		return
+	}
+
+	for _, change := range due {
+		updated, err := roster.Update(change.Username, func(d *driver) error {
+			d.Rate = change.Rate
+			return nil
+		})
+
+		if err == ErrNotInRoster {
+			log.Printf("Scheduled rate %s for user %s dropped as they are not in the roster.", change.ID, change.Username)
+			continue
+		}
+
+		if err != nil {
+			log.Printf("Error: Could not apply scheduled rate %s for user %s : %s", change.ID, change.Username, err)
+			continue
+		}
+
+		recordRate(change.Username, rateChange{Rate: change.Rate, EffectiveAt: now, Reason: rateScheduled, ScheduleID: change.ID})
+		events.publish(rosterEvent{Type: eventRateChanged, Username: change.Username, At: now, Driver: &updated, Reason: rateScheduled})
+		log.Printf("Scheduled rate of %dp applied for user %s", change.Rate, change.Username)
+	}
+}
+
+func applyScheduledRatesEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		applyDueRates(now)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"testing"
+	"time"
+)
+
+func TestApplyDueRates(t *testing.T) {
+	roster = newMemoryRosterStore()
+	now := time.Now()
+
+	roster.Join(driver{Username: "sebvet", Rate: 5, State: stateAvailable})
+	roster.ScheduleRate(scheduledRate{ID: "weekend", Username: "sebvet", Rate: 12, At: now.Add(-time.Second)})
+	roster.ScheduleRate(scheduledRate{ID: "monday", Username: "sebvet", Rate: 6, At: now.Add(time.Hour)})
+	roster.ScheduleRate(scheduledRate{ID: "absent", Username: "babydriver", Rate: 9, At: now.Add(-time.Second)})
+
+	applyDueRates(now)
+
+	if d, _ := roster.Get("sebvet"); d.Rate != 12 {
+		log.Printf("Failed to apply scheduled rate, rate is %dp", d.Rate)
+		t.Fail()
+	}
+
+	history, _ := roster.RateHistory("sebvet")
+	if len(history) != 1 || history[0].Rate != 12 || history[0].Reason != rateScheduled || history[0].ScheduleID != "weekend" {
+		log.Printf("Failed to record scheduled rate in history, got %v", history)
+		t.Fail()
+	}
+
+	// Changes still to come are left alone, and due changes for drivers not in the roster are dropped
+	if scheduled, _ := roster.ScheduledRates("sebvet"); len(scheduled) != 1 || scheduled[0].ID != "monday" {
+		log.Printf("Failed to keep future scheduled rate, got %v", scheduled)
+		t.Fail()
+	}
+
+	if scheduled, _ := roster.ScheduledRates("babydriver"); len(scheduled) != 0 {
+		log.Printf("Failed to drop scheduled rate for driver not in roster, got %v", scheduled)
+		t.Fail()
+	}
+
+	// Applying again does nothing, since each change is taken from the store once
+	roster.Update("sebvet", func(d *driver) error {
+		d.Rate = 7
+		return nil
+	})
+	applyDueRates(now)
+
+	if d, _ := roster.Get("sebvet"); d.Rate != 7 {
+		log.Println("Failed to apply scheduled rate only once")
+		t.Fail()
+	}
+}
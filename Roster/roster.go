@@ -2,49 +2,83 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
 )
 
 type driver struct {
 	Username string `json:"username"`
 	Name string `json:"name"`
 	Rate int `json:"rate"`
+	// One of available, on_trip, on_break or offline. See state.go.
+	State string `json:"state"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	// The vehicle the driver joined with, if they have registered any. See vehicles.go.
+	Vehicle *vehicle `json:"vehicle,omitempty"`
+	// Used to add up working time. See hours.go.
+	JoinedAt time.Time `json:"joined_at"`
+	TripStartedAt *time.Time `json:"trip_started_at,omitempty"`
+	// The shift that put the driver on the roster, if any. See shifts.go.
+	ShiftID string `json:"shift_id,omitempty"`
 }
 
-type driverRequest struct {
-	Token string `json:"token"`
-}
-
+// The JWT used to be sent in a "token" field alongside the rate. It is now read by the middleware,
+// which still accepts it there for the time being.
 type driverRateRequest struct {
-	driverRequest
 	Rate int `json:"rate"`
 }
 
-var Roster = map[string]driver{}
+// Joining also names the registration of the vehicle the driver is using.
+type joinRosterRequest struct {
+	driverRateRequest
+	Vehicle string `json:"vehicle"`
+}
 
+// Drivers currently in the roster. See store.go.
+var roster RosterStore
 
-func authenticateUser(token string) (*driver, error) {
+// Verifies JWTs locally against the keys published by the auth service.
+var verifier *authclient.Verifier
 
-	r, err := http.Get("http://auth-service:8000/validate/"+token)
-	
-	if err != nil || r.StatusCode != http.StatusOK {
-		return nil, errors.New("unauthorised jwt")
-	}
+// Auth's revocation feed, or nil if Roster has no client credentials to read it with.
+var revocations *authclient.Revocations
+
+// Only drivers may use the roster. The JWT is read from the Authorization header,
+// or from the deprecated "token" body field with a warning.
+var requireDriver func(http.Handler) http.Handler
+
+// Drivers may read their own rate history, and admins anyone's. Only the Authorization header is accepted.
+var requireDriverOrAdmin func(http.Handler) http.Handler
+
+// Only admins may manage city zones.
+var requireAdmin func(http.Handler) http.Handler
+
+// Only services holding a token with the roster:read scope may list the roster.
+var requireRosterRead func(http.Handler) http.Handler
 
-	var authenticatedDriver driver
-	json.NewDecoder(r.Body).Decode(&authenticatedDriver)
+// Like requireRosterRead, but also takes the token from where browsers can send it on a stream.
+var requireRosterStream func(http.Handler) http.Handler
+
+// Returns the driver whose token was accepted by requireDriver.
+func authenticatedDriver(r *http.Request) *driver {
+	claims, _ := authclient.ClaimsFromContext(r.Context())
 
 	// Note that just because driver is authenticated, doesn't mean they are in roster
 	// Catch on other side
-	return &authenticatedDriver, nil
+	return &driver{
+		Username: claims.Username,
+		Name: claims.Name,
+	}
 }
 
-// Requires authentication
+// Requires authentication as a driver
 func joinRoster(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -57,34 +91,17 @@ func joinRoster(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var requestData driverRateRequest
+	var requestData joinRosterRequest
 	err = json.Unmarshal(body, &requestData)
 
 	if err != nil {
-		log.Printf("Error: Request is missing JWT token or rate: %s", err)
+		log.Printf("Error: Request is missing rate: %s", err)
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("{\"error\": \"Request is missing JWT token or rate\"}"))
-		return
-	}
-
-	user, err := authenticateUser(requestData.Token)
-
-	if err != nil {
-		log.Printf("Error: Invalid JWT token: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("{\"error\": \"Invalid JWT token\"}"))
+		w.Write([]byte("{\"error\": \"Request is missing rate\"}"))
 		return
 	}
 
-	_, ok := Roster[user.Username]
-
-	// Check if driver is already in roster.
-	if ok {
-		log.Println("Error: User is already in roster.")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("{\"error\": \"User is already in roster\"}"))
-		return
-	}
+	user := authenticatedDriver(r)
 
 	// Cannot have a rate of less than or equal to 0p.
 	if requestData.Rate <= 0 {
@@ -94,65 +111,99 @@ func joinRoster(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// At this point, we can safely add driver to the roster with the given rate
-	// Note we do not ask for username or name in this endpoint.
-	// By the time they have a token, they have already given this information.
-
-	user.Rate = requestData.Rate
-	Roster[user.Username] = *user
-
-	log.Printf("User %s added to roster with rate %dp", user.Username, user.Rate)
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(user)
-}
+	problem, err := checkHours(user.Username, time.Now())
 
-// Requires authentication
-func leaveRoster(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
-	
 	if err != nil {
-		log.Printf("Error: Parsing request to leave roster failed: %s", err)
+		log.Printf("Error: Could not read working hours of user %s : %s", user.Username, err)
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("{\"error\": \"Parsing request to leave roster failed\"}"))
+		w.Write([]byte("{\"error\": \"Could not join roster\"}"))
 		return
 	}
 
-	var requestData driverRequest
-	err = json.Unmarshal(body, &requestData)
+	if problem != "" {
+		log.Printf("Error: User %s cannot join roster : %s", user.Username, problem)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("{\"error\": \"" + problem + "\"}"))
+		return
+	}
+
+	activeVehicle, problem, err := chooseVehicle(user.Username, requestData.Vehicle)
 
 	if err != nil {
-		log.Printf("Error: Request is missing JWT token: %s", err)
+		log.Printf("Error: Could not read vehicles of user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not join roster\"}"))
+		return
+	}
+
+	if problem != "" {
+		log.Printf("Error: User %s cannot join with vehicle %q : %s", user.Username, requestData.Vehicle, problem)
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("{\"error\": \"Request is missing JWT token\"}"))
+		w.Write([]byte("{\"error\": \"" + problem + "\"}"))
 		return
 	}
 
-	user, err := authenticateUser(requestData.Token)
+	// Note we do not ask for username or name in this endpoint.
+	// By the time they have a token, they have already given this information.
+	user.Rate = requestData.Rate
+	user.Vehicle = activeVehicle
+	user.State = stateAvailable
+	user.LastHeartbeat = time.Now()
+	user.JoinedAt = user.LastHeartbeat
+	err = roster.Join(*user)
+
+	// Check if driver is already in roster.
+	if err == ErrAlreadyInRoster {
+		log.Println("Error: User is already in roster.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"User is already in roster\"}"))
+		return
+	}
 
 	if err != nil {
-		log.Printf("Error: Invalid JWT token: %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("{\"error\": \"Invalid JWT token\"}"))
+		log.Printf("Error: Could not add user %s to roster : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not join roster\"}"))
 		return
 	}
 
-	_, ok := Roster[user.Username]
+	recordRate(user.Username, rateChange{Rate: user.Rate, EffectiveAt: user.LastHeartbeat, Reason: rateJoined})
+	events.publish(rosterEvent{Type: eventJoined, Username: user.Username, At: user.LastHeartbeat, Driver: user})
+	log.Printf("User %s added to roster with rate %dp", user.Username, user.Rate)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+// Requires authentication as a driver. No body is needed.
+func leaveRoster(w http.ResponseWriter, r *http.Request) {
+	user := authenticatedDriver(r)
+
+	left, err := roster.Leave(user.Username)
 
 	// Check if driver is already in roster.
-	if !ok {
+	if err == ErrNotInRoster {
 		log.Println("Error: User is not in roster.")
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("{\"error\": \"User is not in roster\"}"))
 		return
 	}
 
-	delete(Roster, user.Username)
+	if err != nil {
+		log.Printf("Error: Could not remove user %s from roster : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not leave roster\"}"))
+		return
+	}
+
+	locations.remove(user.Username)
+	recordLeave(left, time.Now())
+	events.publish(rosterEvent{Type: eventLeft, Username: left.Username, Driver: &left})
 	log.Printf("User %s removed from roster.", user.Username)
 
 	w.WriteHeader(http.StatusOK)
 }
 
-// Requires authentication
+// Requires authentication as a driver
 func changeRate(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -169,55 +220,119 @@ func changeRate(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(body, &requestData)
 
 	if err != nil {
-		log.Printf("Error: Request is missing JWT token or rate : %s", err)
+		log.Printf("Error: Request is missing rate : %s", err)
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("{\"error\": \"Request is missing JWT token or rate\"}"))
+		w.Write([]byte("{\"error\": \"Request is missing rate\"}"))
 		return
 	}
 
-	user, err := authenticateUser(requestData.Token)
+	user := authenticatedDriver(r)
 
-	if err != nil {
-		log.Printf("Error: Invalid JWT token : %s", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("{\"error\": \"Invalid JWT token\"}"))
+	// Cannot have a rate of less than or equal to 0p.
+	if requestData.Rate <= 0 {
+		log.Println("Error: Invalid rate value supplied.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Invalid rate value supplied\"}"))
 		return
 	}
 
-	rosterUser, ok := Roster[user.Username]
+	rosterUser, err := roster.Update(user.Username, func(d *driver) error {
+		d.Rate = requestData.Rate
+		return nil
+	})
 
 	// Check if driver is already in roster.
-	if !ok {
+	if err == ErrNotInRoster {
 		log.Println("Error: User is not in roster.")
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("{\"error\": \"User is not in roster\"}"))
 		return
 	}
 
-	// Cannot have a rate of less than or equal to 0p.
-	if requestData.Rate <= 0 {
-		log.Println("Error: Invalid rate value supplied.")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("{\"error\": \"Invalid rate value supplied\"}"))
+	if err != nil {
+		log.Printf("Error: Could not update rate for user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not update rate\"}"))
 		return
 	}
 
-	rosterUser.Rate = requestData.Rate
-
-	// Replace record in map with updated rate
-	Roster[rosterUser.Username] = rosterUser
-
+	recordRate(rosterUser.Username, rateChange{Rate: rosterUser.Rate, EffectiveAt: time.Now(), Reason: rateChanged})
+	events.publish(rosterEvent{Type: eventRateChanged, Username: rosterUser.Username, Driver: &rosterUser, Reason: rateChanged})
 	log.Printf("Rate updated to %dp for User %s", rosterUser.Rate, rosterUser.Username)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(rosterUser)
 }
 
+// Lists the drivers in the roster who are available. Pass state to list drivers in another state,
+// or state=all for everyone. Drivers can also be filtered by their vehicle; see parseVehicleFilter.
+// Each rate is the one the driver's rate profile gives at the time in at, or now if it is left out.
+// Pass pickup_lat and pickup_lng, or pickup_postcode, to leave out drivers who do not work there.
 func getDrivers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	var returnList []driver
-	for _, value := range Roster {
-		returnList = append(returnList, value)
+
+	state := r.URL.Query().Get("state")
+	if state == "" {
+		state = stateAvailable
+	}
+
+	if state != "all" && !validState(state) {
+		log.Printf("Error: Invalid state %s supplied.", state)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"State must be one of available, on_trip, on_break, offline or all\"}"))
+		return
+	}
+
+	filter, problem := parseVehicleFilter(r)
+
+	if problem != "" {
+		log.Printf("Error: Invalid vehicle filter : %s", problem)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"" + problem + "\"}"))
+		return
+	}
+
+	pickup, problem := parsePickup(r, "pickup_")
+
+	if problem != "" {
+		log.Printf("Error: Invalid pickup : %s", problem)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"" + problem + "\"}"))
+		return
 	}
+
+	at, err := queryTime(r)
+
+	if err != nil {
+		log.Printf("Error: Invalid rate time supplied : %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"at must be an RFC 3339 time\"}"))
+		return
+	}
+
+	drivers, err := roster.List()
+
+	returnList := []driver{}
+	for _, d := range drivers {
+		if (state == "all" || d.State == state) && filter.matches(d) {
+			returnList = append(returnList, d)
+		}
+	}
+
+	if err == nil && pickup.given() {
+		returnList, err = pickup.filter(returnList)
+	}
+
+	if err == nil {
+		err = applyRateProfiles(returnList, at)
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not read roster : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not read roster\"}"))
+		return
+	}
+
 	log.Println("Requesting driver roster info.")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(returnList)
@@ -225,14 +340,123 @@ func getDrivers(w http.ResponseWriter, r *http.Request) {
 
 func handleRequests() {
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/roster", joinRoster).Methods("POST")
-	router.HandleFunc("/roster", leaveRoster).Methods("DELETE")
-	router.HandleFunc("/roster", changeRate).Methods("PUT")
-	router.HandleFunc("/roster", getDrivers).Methods("GET")
+	router.Handle("/roster", requireDriver(http.HandlerFunc(joinRoster))).Methods("POST")
+	router.Handle("/roster", requireDriver(http.HandlerFunc(leaveRoster))).Methods("DELETE")
+	router.Handle("/roster", requireDriver(http.HandlerFunc(changeRate))).Methods("PUT")
+	router.Handle("/roster", requireRosterRead(http.HandlerFunc(getDrivers))).Methods("GET")
+	router.Handle("/roster/vehicles", requireDriver(http.HandlerFunc(listVehicles))).Methods("GET")
+	router.Handle("/roster/vehicles", requireDriver(http.HandlerFunc(addVehicle))).Methods("POST")
+	router.Handle("/roster/vehicles/{registration}", requireDriver(http.HandlerFunc(removeVehicle))).Methods("DELETE")
+	router.Handle("/roster/scheduled-rates", requireDriver(http.HandlerFunc(listScheduledRates))).Methods("GET")
+	router.Handle("/roster/scheduled-rates", requireDriver(http.HandlerFunc(scheduleRate))).Methods("POST")
+	router.Handle("/roster/scheduled-rates/{id}", requireDriver(http.HandlerFunc(cancelScheduledRate))).Methods("DELETE")
+	router.Handle("/roster/rate-profile", requireDriver(http.HandlerFunc(getRateProfile))).Methods("GET")
+	router.Handle("/roster/rate-profile", requireDriver(http.HandlerFunc(setRateProfile))).Methods("PUT")
+	router.Handle("/roster/area", requireDriver(http.HandlerFunc(getArea))).Methods("GET")
+	router.Handle("/roster/area", requireDriver(http.HandlerFunc(setArea))).Methods("PUT")
+	router.Handle("/roster/zones", requireDriverOrAdmin(http.HandlerFunc(listZones))).Methods("GET")
+	router.Handle("/roster/zones/match", requireRosterRead(http.HandlerFunc(matchZones))).Methods("GET")
+	router.Handle("/roster/zones/{id}", requireAdmin(http.HandlerFunc(putZone))).Methods("PUT")
+	router.Handle("/roster/zones/{id}", requireAdmin(http.HandlerFunc(deleteZone))).Methods("DELETE")
+	router.Handle("/roster/shifts", requireDriver(http.HandlerFunc(listShifts))).Methods("GET")
+	router.Handle("/roster/shifts", requireDriver(http.HandlerFunc(addShift))).Methods("POST")
+	router.Handle("/roster/shifts/{id}", requireDriver(http.HandlerFunc(cancelShift))).Methods("DELETE")
+	router.Handle("/roster/{username}/rates", requireDriverOrAdmin(http.HandlerFunc(getRateHistory))).Methods("GET")
+	router.Handle("/roster/{username}/hours", requireDriverOrAdmin(http.HandlerFunc(getHours))).Methods("GET")
+	router.Handle("/roster/state", requireDriver(http.HandlerFunc(changeState))).Methods("PUT")
+	router.Handle("/roster/heartbeat", requireDriver(http.HandlerFunc(heartbeat))).Methods("POST")
+	router.Handle("/roster/location", requireDriver(http.HandlerFunc(updateLocation))).Methods("PUT")
+	router.Handle("/roster/nearby", requireRosterRead(http.HandlerFunc(nearbyDrivers))).Methods("GET")
+	router.Handle("/roster/events", requireRosterStream(http.HandlerFunc(streamEvents))).Methods("GET")
 	log.Fatal(http.ListenAndServe(":8000", router))
 }
 
 func main() {
 	log.Println("Starting Roster Service")
+
+	var err error
+	roster, err = newRosterStore()
+	if err != nil {
+		log.Fatalf("Error: Could not open roster store : %s", err)
+	}
+
+	if ttl := os.Getenv("LOCATION_TTL"); ttl != "" {
+		locations.ttl, err = time.ParseDuration(ttl)
+		if err != nil || locations.ttl <= 0 {
+			log.Fatalf("Error: Invalid LOCATION_TTL %q", ttl)
+		}
+	}
+	go locations.pruneEvery(30 * time.Second)
+
+	if timeout := os.Getenv("HEARTBEAT_TIMEOUT"); timeout != "" {
+		heartbeatTimeout, err = time.ParseDuration(timeout)
+		if err != nil || heartbeatTimeout <= 0 {
+			log.Fatalf("Error: Invalid HEARTBEAT_TIMEOUT %q", timeout)
+		}
+	}
+	go sweepEvery(15 * time.Second)
+	go applyScheduledRatesEvery(10 * time.Second)
+
+	for name, limit := range map[string]*time.Duration{"MAX_ROSTER_TIME": &maxRosterTime, "MAX_TRIP_TIME": &maxTripTime, "MANDATORY_BREAK": &mandatoryBreak} {
+		if value := os.Getenv(name); value != "" {
+			*limit, err = time.ParseDuration(value)
+			if err != nil || *limit <= 0 {
+				log.Fatalf("Error: Invalid %s %q", name, value)
+			}
+		}
+	}
+	go runShiftsEvery(30 * time.Second)
+
+	if size := os.Getenv("EVENT_LOG_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 {
+			log.Fatalf("Error: Invalid EVENT_LOG_SIZE %q", size)
+		}
+		events = newEventLog(n)
+	}
+
+	jwksURL := os.Getenv("AUTH_JWKS_URL")
+	if jwksURL == "" {
+		jwksURL = authclient.DefaultJWKSURL
+	}
+	verifier = authclient.NewVerifier(jwksURL)
+
+	// Poll Auth for users whose tokens were revoked early, e.g. on suspension. This needs a service token.
+	// The verifier checks every token against the feed, so the poll interval is how long a revoked token can
+	// still be used here. It is short, since suspension and deletion should take effect at once.
+	if clientID := os.Getenv("AUTH_CLIENT_ID"); clientID != "" {
+		tokenURL := os.Getenv("AUTH_TOKEN_URL")
+		if tokenURL == "" {
+			tokenURL = authclient.DefaultTokenURL
+		}
+		revocationsURL := os.Getenv("AUTH_REVOCATIONS_URL")
+		if revocationsURL == "" {
+			revocationsURL = authclient.DefaultRevocationsURL
+		}
+
+		pollInterval := time.Second
+		if interval := os.Getenv("REVOCATIONS_POLL_INTERVAL"); interval != "" {
+			pollInterval, err = time.ParseDuration(interval)
+			if err != nil || pollInterval <= 0 {
+				log.Fatalf("Error: Invalid REVOCATIONS_POLL_INTERVAL %q", interval)
+			}
+		}
+
+		credentials := authclient.NewClientCredentials(tokenURL, clientID, os.Getenv("AUTH_CLIENT_SECRET"), "auth:revocations")
+		revocations = authclient.NewRevocations(revocationsURL, credentials.Client())
+		verifier.CheckRevocations(revocations)
+		go revocations.PollEvery(pollInterval)
+	} else {
+		log.Println("Warning: AUTH_CLIENT_ID is not set. Tokens revoked early will be accepted until they expire.")
+	}
+	requireRole := authclient.RequireRole(verifier, authclient.BearerOrBodyToken, authclient.RoleDriver)
+	requireDriver = func(next http.Handler) http.Handler {
+		return authclient.DeprecateBodyToken(requireRole(next))
+	}
+	requireDriverOrAdmin = authclient.RequireRole(verifier, authclient.BearerToken, authclient.RoleDriver, authclient.RoleAdmin)
+	requireAdmin = authclient.RequireRole(verifier, authclient.BearerToken, authclient.RoleAdmin)
+	requireRosterRead = authclient.RequireScope(verifier, authclient.BearerToken, "roster:read")
+	requireRosterStream = authclient.RequireScope(verifier, authclient.StreamToken, "roster:read")
+
 	handleRequests()
 }
\ No newline at end of file
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"log"
@@ -10,17 +11,72 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
 )
 
 type Token struct {
 	Token string `json:"token"`
 }
 
+// Listing the roster needs a service token with the roster:read scope
+var services = authclient.NewClientCredentials(authclient.DefaultTokenURL, "integration-tests", "integration-tests-dev-secret", "roster:read").Client()
+
 type rosterReq struct {
 	Token string `json:"token"`
 	Rate int `json:"rate"`
 }
 
+// Signs in through Auth and returns the user's token, failing the test if that is not possible.
+func signIn(t *testing.T, username, password string) string {
+	data := url.Values{}
+	data.Set("username", username)
+	data.Set("password", password)
+	resp, err := http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Printf("Failed to sign in as %s", username)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+
+	var token Token
+	json.NewDecoder(resp.Body).Decode(&token)
+	return token.Token
+}
+
+// Registers a new driver and signs them in, returning their username and token. Each test uses a driver
+// of its own, so that it does not depend on what other tests have done to the roster or in which order.
+func newDriver(t *testing.T) (string, string) {
+	username := "driver" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	data := url.Values{}
+	data.Set("username", username)
+	data.Set("name", "Test Driver")
+	data.Set("password", "dr1verpassword")
+	data.Set("role", "driver")
+	resp, err := http.PostForm("http://auth-service:8000/register", data)
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		log.Println("Failed to register a driver for the test")
+		t.FailNow()
+	}
+	resp.Body.Close()
+
+	return username, signIn(t, username, "dr1verpassword")
+}
+
+// Sends a request to Roster with token in the Authorization header.
+func as(token, method, path, body string) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://roster-service:8000"+path, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	return http.DefaultClient.Do(req)
+}
+
 func TestRoster(t *testing.T) {
 	// Sleep to ensure other services have finished build
 	time.Sleep(3 * time.Second)
@@ -41,7 +97,7 @@ func TestRoster(t *testing.T) {
 	json.NewDecoder(resp.Body).Decode(&token)
 
 	// Test getting roster. Should be empty. 
-	resp, err := http.Get("http://roster-service:8000/roster")
+	resp, err := services.Get("http://roster-service:8000/roster")
 	if err != nil {
 		log.Println("Failed fetching roster")
 		t.Fail()
@@ -95,7 +151,7 @@ func TestRoster(t *testing.T) {
 	resp, _ = client.Do(req) 
 
 	// Get users in roster to see if removal has worked
-	resp, err = http.Get("http://roster-service:8000/roster")
+	resp, err = services.Get("http://roster-service:8000/roster")
 	if err != nil {
 		log.Println("Failed fetching roster")
 		t.Fail()
@@ -108,3 +164,654 @@ func TestRoster(t *testing.T) {
 		t.Fail()
 	}
 }	
+
+
+func TestRosterRequiresDriverRole(t *testing.T) {
+	// Register a rider, who should not be able to join the roster
+	data := url.Values{}
+	data.Set("username", "rider" + strconv.FormatInt(time.Now().UnixNano() % 1000000000, 10))
+	data.Set("name", "Roster Rider")
+	data.Set("password", "r1derpassword")
+
+	resp, err := http.PostForm("http://auth-service:8000/register", data)
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		log.Println("Failed to register rider before roster role test")
+		t.FailNow()
+	}
+
+	var token Token
+	json.NewDecoder(resp.Body).Decode(&token)
+
+	joinRosterReq := rosterReq{
+		Token: token.Token,
+		Rate: 5,
+	}
+	payload := new(bytes.Buffer)
+	json.NewEncoder(payload).Encode(joinRosterReq)
+	resp, err = http.Post("http://roster-service:8000/roster", "application/json", payload)
+
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		log.Println("Failed to stop a rider joining the roster")
+		t.Fail()
+	}
+}
+
+func TestRosterRequiresServiceToken(t *testing.T) {
+	resp, err := http.Get("http://roster-service:8000/roster")
+
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		log.Println("Failed to reject roster listing without a service token")
+		t.Fail()
+	}
+
+	// A driver's own token does not carry the roster:read scope
+	data := url.Values{}
+	data.Set("username", "babydriver")
+	data.Set("password", "edgarwright")
+	resp, err = http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to sign in before service token unit test.")
+		t.FailNow()
+	}
+
+	var token Token
+	json.NewDecoder(resp.Body).Decode(&token)
+
+	req, _ := http.NewRequest("GET", "http://roster-service:8000/roster", nil)
+	req.Header.Add("Authorization", "Bearer "+token.Token)
+	resp, err = http.DefaultClient.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		log.Println("Failed to reject roster listing with a user token")
+		t.Fail()
+	}
+}
+
+func TestRosterBearerToken(t *testing.T) {
+	data := url.Values{}
+	data.Set("username", "babydriver")
+	data.Set("password", "edgarwright")
+	resp, err := http.PostForm("http://auth-service:8000/login", data)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to sign in before bearer token unit test.")
+		t.FailNow()
+	}
+
+	var token Token
+	json.NewDecoder(resp.Body).Decode(&token)
+
+	// Join with the token in the Authorization header, so the body only holds the rate
+	req, _ := http.NewRequest("POST", "http://roster-service:8000/roster", strings.NewReader("{\"rate\": 7}"))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token.Token)
+	resp, err = http.DefaultClient.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Deprecation") != "" {
+		log.Println("Failed to join roster with Authorization header")
+		t.FailNow()
+	}
+
+	// The deprecated body token still works, but is flagged
+	payload := new(bytes.Buffer)
+	json.NewEncoder(payload).Encode(rosterReq{Token: token.Token, Rate: 8})
+	req, _ = http.NewRequest("PUT", "http://roster-service:8000/roster", payload)
+	req.Header.Add("Content-Type", "application/json")
+	resp, err = http.DefaultClient.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Deprecation") != "true" || resp.Header.Get("Warning") == "" {
+		log.Println("Failed to warn about deprecated body token")
+		t.Fail()
+	}
+
+	// Leaving needs no body at all
+	req, _ = http.NewRequest("DELETE", "http://roster-service:8000/roster", nil)
+	req.Header.Add("Authorization", "Bearer "+token.Token)
+	resp, err = http.DefaultClient.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to leave roster with Authorization header")
+		t.Fail()
+	}
+}
+
+func TestRosterNearby(t *testing.T) {
+	username, token := newDriver(t)
+
+	// Only drivers in the roster can report their location
+	resp, err := as(token, "PUT", "/roster/location", "{\"lat\": 51.5031, \"lng\": -0.1132}")
+
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		log.Println("Failed to refuse location from driver not in roster")
+		t.Fail()
+	}
+
+	as(token, "POST", "/roster", "{\"rate\": 6}")
+	resp, err = as(token, "PUT", "/roster/location", "{\"lat\": 51.5031, \"lng\": -0.1132}")
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to update location")
+		t.FailNow()
+	}
+
+	type nearbyResult struct {
+		Username string  `json:"username"`
+		Rate     int     `json:"rate"`
+		Distance float64 `json:"distance_km"`
+	}
+
+	// Returns this test's driver if the search found them. Other drivers may be nearby too.
+	search := func(query string) (found *nearbyResult, ok bool) {
+		resp, err := services.Get("http://roster-service:8000/roster/nearby?" + query)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return nil, false
+		}
+
+		var nearby []nearbyResult
+		json.NewDecoder(resp.Body).Decode(&nearby)
+		for i := range nearby {
+			if nearby[i].Username == username {
+				return &nearby[i], true
+			}
+		}
+		return nil, true
+	}
+
+	// Westminster Bridge is under a kilometre from Waterloo
+	found, ok := search("lat=51.5008&lng=-0.1219&radius=2")
+
+	if !ok || found == nil || found.Rate != 6 || found.Distance > 1 {
+		log.Println("Failed to find nearby driver")
+		t.Fail()
+	}
+
+	// Manchester is well out of range
+	found, ok = search("lat=53.4774&lng=-2.2309")
+
+	if !ok || found != nil {
+		log.Println("Failed to exclude distant driver from nearby search")
+		t.Fail()
+	}
+
+	// Leaving the roster drops the driver from the search
+	as(token, "DELETE", "/roster", "")
+	found, ok = search("lat=51.5008&lng=-0.1219&radius=2")
+
+	if !ok || found != nil {
+		log.Println("Failed to drop driver who left the roster from nearby search")
+		t.Fail()
+	}
+}
+
+func TestRosterStates(t *testing.T) {
+	username, token := newDriver(t)
+
+	listed := func(query string) bool {
+		resp, err := services.Get("http://roster-service:8000/roster" + query)
+		if err != nil {
+			return false
+		}
+
+		var drivers []driver
+		json.NewDecoder(resp.Body).Decode(&drivers)
+		for _, d := range drivers {
+			if d.Username == username {
+				return true
+			}
+		}
+		return false
+	}
+
+	resp, err := as(token, "POST", "/roster", "{\"rate\": 9}")
+
+	var joined driver
+	if err == nil {
+		json.NewDecoder(resp.Body).Decode(&joined)
+	}
+
+	if err != nil || joined.State != "available" || !listed("") {
+		log.Println("Failed to join roster as an available driver")
+		t.FailNow()
+	}
+
+	// Drivers on a break are not offered to riders, but can still be listed
+	resp, err = as(token, "PUT", "/roster/state", "{\"state\": \"on_break\"}")
+
+	if err != nil || resp.StatusCode != http.StatusOK || listed("") || !listed("?state=all") || !listed("?state=on_break") {
+		log.Println("Failed to take a break")
+		t.Fail()
+	}
+
+	// A trip cannot start from a break
+	resp, err = as(token, "PUT", "/roster/state", "{\"state\": \"on_trip\"}")
+
+	if err != nil || resp.StatusCode != http.StatusConflict {
+		log.Println("Failed to refuse invalid state change")
+		t.Fail()
+	}
+
+	resp, err = as(token, "PUT", "/roster/state", "{\"state\": \"asleep\"}")
+
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		log.Println("Failed to refuse unknown state")
+		t.Fail()
+	}
+
+	resp, err = as(token, "POST", "/roster/heartbeat", "")
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to record heartbeat")
+		t.Fail()
+	}
+
+	as(token, "PUT", "/roster/state", "{\"state\": \"available\"}")
+
+	if !listed("") {
+		log.Println("Failed to return from break")
+		t.Fail()
+	}
+
+	as(token, "DELETE", "/roster", "")
+}
+
+func TestRosterVehicles(t *testing.T) {
+	username, token := newDriver(t)
+
+	listed := func(query string) bool {
+		resp, err := services.Get("http://roster-service:8000/roster" + query)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return false
+		}
+
+		var drivers []driver
+		json.NewDecoder(resp.Body).Decode(&drivers)
+		for _, d := range drivers {
+			if d.Username == username {
+				return true
+			}
+		}
+		return false
+	}
+
+	resp, err := as(token, "POST", "/roster/vehicles", "{\"registration\": \"ab12 cde\", \"make\": \"Ford\", \"model\": \"Galaxy\", \"seats\": 7, \"fuel_type\": \"diesel\", \"accessibility\": [\"wheelchair\"]}")
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		log.Println("Failed to register vehicle")
+		t.FailNow()
+	}
+
+	resp, err = as(token, "POST", "/roster/vehicles", "{\"registration\": \"XY21ZZZ\", \"make\": \"Nissan\", \"model\": \"Leaf\", \"seats\": 4, \"fuel_type\": \"electric\"}")
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		log.Println("Failed to register second vehicle")
+		t.FailNow()
+	}
+
+	resp, err = as(token, "POST", "/roster/vehicles", "{\"registration\": \"TOO MANY\", \"make\": \"Bus\", \"model\": \"Routemaster\", \"seats\": 64, \"fuel_type\": \"diesel\"}")
+
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		log.Println("Failed to refuse vehicle with too many seats")
+		t.Fail()
+	}
+
+	// With two vehicles registered, the driver has to say which one they are using
+	resp, err = as(token, "POST", "/roster", "{\"rate\": 8}")
+
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		log.Println("Failed to require a vehicle choice")
+		t.Fail()
+	}
+
+	resp, err = as(token, "POST", "/roster", "{\"rate\": 8, \"vehicle\": \"AB12CDE\"}")
+
+	var joined driver
+	if err == nil {
+		json.NewDecoder(resp.Body).Decode(&joined)
+	}
+
+	if err != nil || resp.StatusCode != http.StatusOK || joined.Vehicle == nil || joined.Vehicle.Seats != 7 {
+		log.Println("Failed to join roster with chosen vehicle")
+		t.FailNow()
+	}
+
+	if !listed("?min_seats=6&accessibility=wheelchair") || listed("?fuel_type=electric") {
+		log.Println("Failed to filter roster by vehicle")
+		t.Fail()
+	}
+
+	resp, err = as(token, "DELETE", "/roster/vehicles/AB12CDE", "")
+
+	if err != nil || resp.StatusCode != http.StatusConflict {
+		log.Println("Failed to refuse removing vehicle in use")
+		t.Fail()
+	}
+
+	as(token, "DELETE", "/roster", "")
+
+	for _, registration := range []string{"AB12CDE", "XY21ZZZ"} {
+		resp, err = as(token, "DELETE", "/roster/vehicles/"+registration, "")
+
+		if err != nil || resp.StatusCode != http.StatusNoContent {
+			log.Printf("Failed to remove vehicle %s", registration)
+			t.Fail()
+		}
+	}
+}
+
+func TestRosterRates(t *testing.T) {
+	username, token := newDriver(t)
+
+	type rateHistory struct {
+		History []struct {
+			Rate   int    `json:"rate"`
+			Reason string `json:"reason"`
+		} `json:"history"`
+		Scheduled []struct {
+			ID   string `json:"id"`
+			Rate int    `json:"rate"`
+		} `json:"scheduled"`
+	}
+
+	// Times are given to the second, so leave a second either side of since
+	as(token, "POST", "/roster", "{\"rate\": 5}")
+	time.Sleep(time.Second)
+	since := time.Now().UTC().Format(time.RFC3339)
+	time.Sleep(time.Second)
+	as(token, "PUT", "/roster", "{\"rate\": 11}")
+
+	// A weekend rate, starting an hour from now
+	at := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	resp, err := as(token, "POST", "/roster/scheduled-rates", "{\"rate\": 14, \"at\": \""+at+"\"}")
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		log.Println("Failed to schedule rate change")
+		t.Fail()
+	}
+
+	resp, err = as(token, "POST", "/roster/scheduled-rates", "{\"rate\": 14, \"at\": \"2001-01-01T00:00:00Z\"}")
+
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		log.Println("Failed to refuse rate change scheduled in the past")
+		t.Fail()
+	}
+
+	resp, err = as(token, "GET", "/roster/"+username+"/rates?since="+since, "")
+
+	var history rateHistory
+	if err == nil {
+		json.NewDecoder(resp.Body).Decode(&history)
+	}
+
+	// The rate in force at since, set on joining, comes first
+	if err != nil || resp.StatusCode != http.StatusOK || len(history.History) != 2 || history.History[0].Reason != "joined" ||
+		history.History[0].Rate != 5 || history.History[1].Rate != 11 || len(history.Scheduled) != 1 {
+		log.Println("Failed to read rate history")
+		t.FailNow()
+	}
+
+	// Drivers cannot read each other's history
+	resp, err = as(token, "GET", "/roster/sebvet/rates", "")
+
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		log.Println("Failed to keep rate history private")
+		t.Fail()
+	}
+
+	resp, err = as(token, "DELETE", "/roster/scheduled-rates/"+history.Scheduled[0].ID, "")
+
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		log.Println("Failed to cancel scheduled rate")
+		t.Fail()
+	}
+
+	as(token, "DELETE", "/roster", "")
+}
+
+func TestRosterRateProfiles(t *testing.T) {
+	username, token := newDriver(t)
+
+	rateAt := func(at string) int {
+		resp, err := services.Get("http://roster-service:8000/roster?at=" + url.QueryEscape(at))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return -1
+		}
+		var drivers []driver
+		json.NewDecoder(resp.Body).Decode(&drivers)
+		for _, d := range drivers {
+			if d.Username == username {
+				return d.Rate
+			}
+		}
+		return 0
+	}
+
+	as(token, "POST", "/roster", "{\"rate\": 5}")
+
+	// Weekday rush hour and Christmas Day
+	profile := `{"weekly": [{"days": ["mon", "tue", "wed", "thu", "fri"], "start": "07:00", "end": "10:00", "rate": 9}],
+		"overrides": [{"date": "2030-12-25", "rate": 20}]}`
+	resp, err := as(token, "PUT", "/roster/rate-profile", profile)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to set rate profile")
+		t.Fail()
+	}
+
+	// 08:00 on Monday 1st July 2030 in London is 07:00 UTC
+	if rate := rateAt("2030-07-01T07:00:00Z"); rate != 9 {
+		log.Printf("Failed to apply rush hour rate, got %dp", rate)
+		t.Fail()
+	}
+
+	if rate := rateAt("2030-07-01T12:00:00Z"); rate != 5 {
+		log.Printf("Failed to fall back to flat rate, got %dp", rate)
+		t.Fail()
+	}
+
+	// Christmas Day 2030 is a Wednesday, but the override wins over rush hour
+	if rate := rateAt("2030-12-25T08:00:00Z"); rate != 20 {
+		log.Printf("Failed to apply date override, got %dp", rate)
+		t.Fail()
+	}
+
+	resp, err = as(token, "PUT", "/roster/rate-profile", `{"weekly": [{"days": ["mon"], "start": "07:00", "end": "10:00", "rate": 9}, {"days": ["mon"], "start": "09:00", "end": "11:00", "rate": 8}]}`)
+
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		log.Println("Failed to refuse overlapping windows")
+		t.Fail()
+	}
+
+	as(token, "DELETE", "/roster", "")
+}
+
+func TestRosterZones(t *testing.T) {
+	username, driverToken := newDriver(t)
+	adminToken := signIn(t, "admin", "pitwall2021")
+
+	listedAt := func(query string) bool {
+		resp, err := services.Get("http://roster-service:8000/roster?" + query)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return false
+		}
+		var drivers []driver
+		json.NewDecoder(resp.Body).Decode(&drivers)
+		for _, d := range drivers {
+			if d.Username == username {
+				return true
+			}
+		}
+		return false
+	}
+
+	exeter := `{"name": "Exeter", "geometry": {"type": "Polygon", "coordinates": [[[-3.56, 50.70], [-3.50, 50.70], [-3.50, 50.74], [-3.56, 50.74], [-3.56, 50.70]]]}}`
+
+	resp, err := as(driverToken, "PUT", "/roster/zones/exeter", exeter)
+
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		log.Println("Failed to stop driver defining zones")
+		t.Fail()
+	}
+
+	resp, err = as(adminToken, "PUT", "/roster/zones/exeter", exeter)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to define zone")
+		t.FailNow()
+	}
+
+	resp, err = as(driverToken, "PUT", "/roster/area", `{"zones": ["exeter"], "districts": ["EX17"]}`)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to set operating area")
+		t.Fail()
+	}
+
+	as(driverToken, "POST", "/roster", "{\"rate\": 5}")
+
+	if !listedAt("pickup_lat=50.7292&pickup_lng=-3.5435") {
+		log.Println("Failed to list driver for pickup in their zone")
+		t.Fail()
+	}
+
+	if listedAt("pickup_lat=51.5008&pickup_lng=-0.1219") {
+		log.Println("Failed to leave out driver for pickup outside their area")
+		t.Fail()
+	}
+
+	if !listedAt("pickup_postcode=EX17+1AB") {
+		log.Println("Failed to list driver for pickup in their postcode district")
+		t.Fail()
+	}
+
+	resp, err = services.Get("http://roster-service:8000/roster/zones/match?lat=50.7292&lng=-3.5435")
+
+	var zones []struct {
+		ID string `json:"id"`
+	}
+	if err == nil {
+		json.NewDecoder(resp.Body).Decode(&zones)
+	}
+
+	if err != nil || resp.StatusCode != http.StatusOK || len(zones) != 1 || zones[0].ID != "exeter" {
+		log.Println("Failed to find zone taking in point")
+		t.Fail()
+	}
+
+	as(driverToken, "DELETE", "/roster", "")
+	as(adminToken, "DELETE", "/roster/zones/exeter", "")
+}
+
+func TestRosterShifts(t *testing.T) {
+	username, token := newDriver(t)
+
+	start := time.Now().Add(24 * time.Hour).UTC()
+	shift := func(from, to time.Time) string {
+		return "{\"start\": \"" + from.Format(time.RFC3339) + "\", \"end\": \"" + to.Format(time.RFC3339) + "\", \"rate\": 8}"
+	}
+
+	resp, err := as(token, "POST", "/roster/shifts", shift(start, start.Add(8*time.Hour)))
+
+	var planned struct {
+		ID string `json:"id"`
+	}
+	if err == nil {
+		json.NewDecoder(resp.Body).Decode(&planned)
+	}
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		log.Println("Failed to plan shift")
+		t.FailNow()
+	}
+
+	resp, err = as(token, "POST", "/roster/shifts", shift(start.Add(4*time.Hour), start.Add(10*time.Hour)))
+
+	if err != nil || resp.StatusCode != http.StatusConflict {
+		log.Println("Failed to refuse overlapping shift")
+		t.Fail()
+	}
+
+	resp, err = as(token, "POST", "/roster/shifts", shift(start, start.Add(25*time.Hour)))
+
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		log.Println("Failed to refuse shift over 24 hours")
+		t.Fail()
+	}
+
+	resp, err = as(token, "GET", "/roster/"+username+"/hours", "")
+
+	var hours struct {
+		MaxOnRosterMinutes int `json:"max_on_roster_minutes"`
+	}
+	if err == nil {
+		json.NewDecoder(resp.Body).Decode(&hours)
+	}
+
+	if err != nil || resp.StatusCode != http.StatusOK || hours.MaxOnRosterMinutes <= 0 {
+		log.Println("Failed to read working hours")
+		t.Fail()
+	}
+
+	resp, err = as(token, "GET", "/roster/sebvet/hours", "")
+
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		log.Println("Failed to keep working hours private")
+		t.Fail()
+	}
+
+	resp, err = as(token, "DELETE", "/roster/shifts/"+planned.ID, "")
+
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		log.Println("Failed to cancel shift")
+		t.Fail()
+	}
+}
+
+func TestRosterEvents(t *testing.T) {
+	username, token := newDriver(t)
+
+	// Drivers cannot watch the roster
+	resp, err := as(token, "GET", "/roster/events", "")
+
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		log.Println("Failed to refuse event stream to driver")
+		t.Fail()
+	}
+
+	stream, err := services.Get("http://roster-service:8000/roster/events")
+
+	if err != nil || stream.StatusCode != http.StatusOK {
+		log.Println("Failed to open event stream")
+		t.FailNow()
+	}
+	defer stream.Body.Close()
+
+	resp, err = as(token, "POST", "/roster", "{\"rate\": 6}")
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Println("Failed to join roster")
+		t.FailNow()
+	}
+
+	as(token, "DELETE", "/roster", "")
+
+	var seen []string
+	lines := bufio.NewScanner(stream.Body)
+	for len(seen) < 2 && lines.Scan() {
+		if !strings.HasPrefix(lines.Text(), "data: ") {
+			continue
+		}
+
+		var e rosterEvent
+		json.Unmarshal([]byte(strings.TrimPrefix(lines.Text(), "data: ")), &e)
+		if e.Username == username {
+			seen = append(seen, e.Type)
+		}
+	}
+
+	if strings.Join(seen, " ") != "joined left" {
+		log.Printf("Failed to stream joining and leaving roster, got %v", seen)
+		t.Fail()
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Shifts can be planned up to 30 days ahead and last at most a day. A driver can have this many planned at once.
+const maxShiftAhead = 30 * 24 * time.Hour
+const maxShiftLength = 24 * time.Hour
+const maxShifts = 50
+
+// A planned stretch of work. The driver is put on the roster at the start, with the rate and vehicle given,
+// and taken off at the end.
+type shift struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Rate     int       `json:"rate"`
+	Vehicle  string    `json:"vehicle,omitempty"`
+	// Set once the driver has been put on the roster for the shift, or was already on it.
+	Started bool `json:"started"`
+	// When the driver planned the shift, so that it can be dropped if their tokens are revoked after that.
+	PlannedAt time.Time `json:"planned_at"`
+}
+
+type shiftRequest struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Rate    int       `json:"rate"`
+	Vehicle string    `json:"vehicle"`
+}
+
+// Requires authentication as a driver. Lists the driver's planned shifts, soonest first.
+func listShifts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := authenticatedDriver(r)
+
+	shifts, err := roster.Shifts(user.Username)
+
+	if err != nil {
+		log.Printf("Error: Could not read shifts of user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not read shifts\"}"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(shifts)
+}
+
+// Requires authentication as a driver. Plans a shift. Shifts cannot overlap.
+func addShift(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Printf("Error: Parsing request to plan shift failed : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Parsing request to plan shift failed\"}"))
+		return
+	}
+
+	var requestData shiftRequest
+	err = json.Unmarshal(body, &requestData)
+
+	if err != nil || requestData.Start.IsZero() || requestData.End.IsZero() {
+		log.Println("Error: Request is missing start, end or rate")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Request is missing start, end or rate\"}"))
+		return
+	}
+
+	// Cannot have a rate of less than or equal to 0p.
+	if requestData.Rate <= 0 {
+		log.Println("Error: Invalid rate value supplied.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Invalid rate value supplied\"}"))
+		return
+	}
+
+	now := time.Now()
+	if !requestData.End.After(requestData.Start) || !requestData.End.After(now) ||
+		requestData.Start.Sub(now) > maxShiftAhead || requestData.End.Sub(requestData.Start) > maxShiftLength {
+		log.Printf("Error: Shift from %s to %s is out of range.", requestData.Start, requestData.End)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Shifts must end after they start and after now, start in the next 30 days and last at most 24 hours\"}"))
+		return
+	}
+
+	user := authenticatedDriver(r)
+
+	// Checked now as well as at the start of the shift, so that the driver finds out about a problem straight away
+	_, problem, err := chooseVehicle(user.Username, requestData.Vehicle)
+
+	if err != nil {
+		log.Printf("Error: Could not read vehicles of user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not plan shift\"}"))
+		return
+	}
+
+	if problem != "" {
+		log.Printf("Error: User %s cannot plan shift with vehicle %q : %s", user.Username, requestData.Vehicle, problem)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"" + problem + "\"}"))
+		return
+	}
+
+	planned := shift{
+		Username:  user.Username,
+		Name:      user.Name,
+		Start:     requestData.Start.UTC(),
+		End:       requestData.End.UTC(),
+		Rate:      requestData.Rate,
+		Vehicle:   normaliseRegistration(requestData.Vehicle),
+		PlannedAt: now.UTC(),
+	}
+	planned.ID, err = newScheduleID()
+	if err == nil {
+		err = roster.AddShift(planned, maxShifts)
+	}
+
+	if err == ErrTooManyShifts {
+		log.Printf("Error: User %s has too many shifts planned.", user.Username)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("{\"error\": \"Too many shifts planned\"}"))
+		return
+	}
+
+	if err == ErrShiftOverlaps {
+		log.Printf("Error: Shift for user %s overlaps another shift", user.Username)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("{\"error\": \"Shift overlaps another shift\"}"))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not plan shift for user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not plan shift\"}"))
+		return
+	}
+
+	log.Printf("Shift %s planned for user %s from %s to %s", planned.ID, planned.Username, planned.Start, planned.End)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(planned)
+}
+
+// Requires authentication as a driver. Cancels one of the driver's shifts. Cancelling a shift that has
+// started leaves the driver on the roster until they leave themselves.
+func cancelShift(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user := authenticatedDriver(r)
+	id := mux.Vars(r)["id"]
+
+	err := roster.CancelShift(user.Username, id)
+
+	if err == ErrShiftNotFound {
+		log.Printf("Error: User %s has no shift %s", user.Username, id)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{\"error\": \"Shift not found\"}"))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not cancel shift for user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not cancel shift\"}"))
+		return
+	}
+
+	log.Printf("User %s cancelled shift %s.", user.Username, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errShiftStarted = errors.New("shift has already started")
+
+// Puts the driver on the roster for their shift. A driver on a mandatory break is tried again on the
+// next run, so they join part way through the shift once the break is over.
+func startShift(planned shift, now time.Time) {
+	// Reports whether the shift was still planned and has now been marked as started. The shift is updated in
+	// the store rather than overwritten, so that one cancelled since runShifts read it is not brought back.
+	setStarted := func(started bool) bool {
+		_, err := roster.UpdateShift(planned.Username, planned.ID, func(s *shift) error {
+			if started && s.Started {
+				return errShiftStarted
+			}
+			s.Started = started
+			return nil
+		})
+		if err == ErrShiftNotFound || err == errShiftStarted {
+			return false
+		}
+		if err != nil {
+			log.Printf("Error: Could not save shift %s : %s", planned.ID, err)
+			return false
+		}
+		return true
+	}
+
+	problem, err := checkHours(planned.Username, now)
+	if err != nil {
+		log.Printf("Error: Could not read working hours of user %s : %s", planned.Username, err)
+		return
+	}
+	if problem != "" {
+		return
+	}
+
+	activeVehicle, problem, err := chooseVehicle(planned.Username, planned.Vehicle)
+	if err != nil {
+		log.Printf("Error: Could not read vehicles of user %s : %s", planned.Username, err)
+		return
+	}
+	if problem != "" {
+		log.Printf("Error: User %s cannot start shift %s : %s", planned.Username, planned.ID, problem)
+		setStarted(true)
+		return
+	}
+
+	// Claimed before joining, so that a shift cancelled by now does not put the driver on the roster
+	if !setStarted(true) {
+		return
+	}
+
+	d := driver{
+		Username:      planned.Username,
+		Name:          planned.Name,
+		Rate:          planned.Rate,
+		State:         stateAvailable,
+		LastHeartbeat: now,
+		Vehicle:       activeVehicle,
+		JoinedAt:      now,
+		ShiftID:       planned.ID,
+	}
+	err = roster.Join(d)
+
+	if err == ErrAlreadyInRoster {
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not add user %s to roster for shift %s : %s", planned.Username, planned.ID, err)
+		// Tried again on the next run
+		setStarted(false)
+		return
+	}
+
+	recordRate(d.Username, rateChange{Rate: d.Rate, EffectiveAt: now, Reason: rateJoined})
+	events.publish(rosterEvent{Type: eventJoined, Username: d.Username, At: now, Driver: &d})
+	log.Printf("User %s added to roster for shift %s with rate %dp", d.Username, planned.ID, d.Rate)
+}
+
+var errOtherShift = errors.New("driver is not on the roster for this shift")
+
+// Takes the driver off the roster at the end of their shift, if the shift put them on it, and forgets the shift.
+// Drivers on a trip are left to finish it first.
+func endShift(planned shift, now time.Time) {
+	// Checked as the driver leaves, so that one who has just started a trip is not taken off
+	left, err := roster.LeaveIf(planned.Username, func(d driver) error {
+		if d.ShiftID != planned.ID {
+			return errOtherShift
+		}
+		if d.State == stateOnTrip {
+			return errOnTrip
+		}
+		return nil
+	})
+
+	if err == errOnTrip {
+		return
+	}
+
+	if err == nil {
+		locations.remove(left.Username)
+		recordLeave(left, now)
+		events.publish(rosterEvent{Type: eventLeft, Username: left.Username, At: now, Driver: &left, Reason: reasonShiftEnded})
+		log.Printf("User %s removed from roster at the end of shift %s.", left.Username, planned.ID)
+	} else if err != ErrNotInRoster && err != errOtherShift {
+		log.Printf("Error: Could not remove user %s from roster at the end of shift %s : %s", planned.Username, planned.ID, err)
+		return
+	}
+
+	if err := roster.CancelShift(planned.Username, planned.ID); err != nil && err != ErrShiftNotFound {
+		log.Printf("Error: Could not remove shift %s : %s", planned.ID, err)
+	}
+}
+
+// Drops a shift that has not started if every token the driver had when they planned it has since been revoked,
+// e.g. because they were suspended or deleted, so that it does not put them back on the roster. Reports whether
+// the shift was dropped. Auth lists a revocation for a few minutes, and every planned shift is checked on each
+// run, so a revocation is only missed if Roster is down for all of that time.
+func dropRevokedShift(planned shift) bool {
+	if revocations == nil || !revocations.RevokedSince(planned.Username, planned.PlannedAt) {
+		return false
+	}
+
+	if err := roster.CancelShift(planned.Username, planned.ID); err != nil && err != ErrShiftNotFound {
+		log.Printf("Error: Could not drop shift %s of revoked user %s : %s", planned.ID, planned.Username, err)
+		return true
+	}
+	log.Printf("Shift %s dropped as the tokens of user %s were revoked after it was planned.", planned.ID, planned.Username)
+	return true
+}
+
+// Starts and ends the shifts that are due.
+func runShifts(now time.Time) {
+	shifts, err := roster.AllShifts()
+	if err != nil {
+		log.Printf("Error: Could not read shifts : %s", err)
+		return
+	}
+
+	for _, planned := range shifts {
+		if !planned.Started && dropRevokedShift(planned) {
+			continue
+		}
+
+		if !now.Before(planned.End) {
+			endShift(planned, now)
+		} else if !planned.Started && !now.Before(planned.Start) {
+			startShift(planned, now)
+		}
+	}
+}
+
+func runShiftsEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		runShifts(now)
+		enforceHoursLimits(now)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
+)
+
+func TestRunShifts(t *testing.T) {
+	roster = newMemoryRosterStore()
+	now := time.Now()
+
+	roster.AddShift(shift{ID: "morning", Username: "sebvet", Name: "Sebastian Vettel", Start: now.Add(-time.Minute), End: now.Add(time.Hour), Rate: 9}, maxShifts)
+	roster.AddShift(shift{ID: "later", Username: "sebvet", Start: now.Add(2 * time.Hour), End: now.Add(3 * time.Hour), Rate: 9}, maxShifts)
+	// babydriver joined by hand before their shift started
+	roster.Join(driver{Username: "babydriver", Rate: 5, State: stateAvailable, JoinedAt: now.Add(-time.Hour)})
+	roster.AddShift(shift{ID: "evening", Username: "babydriver", Start: now.Add(-time.Minute), End: now.Add(time.Hour), Rate: 7}, maxShifts)
+
+	runShifts(now)
+
+	d, err := roster.Get("sebvet")
+	if err != nil || d.Rate != 9 || d.ShiftID != "morning" || d.State != stateAvailable {
+		log.Printf("Failed to join roster at start of shift, got %v", d)
+		t.FailNow()
+	}
+
+	if d, _ := roster.Get("babydriver"); d.Rate != 5 || d.ShiftID != "" {
+		log.Println("Failed to leave driver already in roster alone")
+		t.Fail()
+	}
+
+	runShifts(now.Add(time.Hour))
+
+	if _, err := roster.Get("sebvet"); err != ErrNotInRoster {
+		log.Println("Failed to leave roster at end of shift")
+		t.Fail()
+	}
+
+	// The shift did not put babydriver on the roster, so it does not take them off
+	if _, err := roster.Get("babydriver"); err != nil {
+		log.Println("Failed to keep driver who joined by hand")
+		t.Fail()
+	}
+
+	if shifts, _ := roster.AllShifts(); len(shifts) != 1 || shifts[0].ID != "later" {
+		log.Printf("Failed to forget finished shifts, got %v", shifts)
+		t.Fail()
+	}
+
+	if h, _ := roster.Hours("sebvet"); len(h.Periods) != 1 || h.Periods[0].End.Sub(h.Periods[0].Start) != time.Hour {
+		log.Printf("Failed to record time on shift, got %v", h.Periods)
+		t.Fail()
+	}
+}
+
+func TestStartShiftCancelled(t *testing.T) {
+	roster = newMemoryRosterStore()
+	now := time.Now()
+
+	planned := shift{ID: "morning", Username: "sebvet", Start: now.Add(-time.Minute), End: now.Add(time.Hour), Rate: 9}
+	roster.AddShift(planned, maxShifts)
+
+	// The driver cancels after runShifts has read the shift but before it is started
+	roster.CancelShift("sebvet", "morning")
+	startShift(planned, now)
+
+	if _, err := roster.Get("sebvet"); err != ErrNotInRoster {
+		log.Println("Failed to keep driver off the roster for cancelled shift")
+		t.Fail()
+	}
+
+	if shifts, _ := roster.AllShifts(); len(shifts) != 0 {
+		log.Printf("Failed to keep cancelled shift cancelled, got %v", shifts)
+		t.Fail()
+	}
+}
+
+func TestRunShiftsDropsRevokedShifts(t *testing.T) {
+	roster = newMemoryRosterStore()
+	now := time.Now()
+
+	// sebvet was suspended after planning their shift, and babydriver before planning theirs
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "{\"users\": [{\"username\": \"sebvet\", \"not_before\": %d}, {\"username\": \"babydriver\", \"not_before\": %d}]}",
+			now.Add(-time.Minute).Unix(), now.Add(-time.Hour).Unix())
+	}))
+	defer feed.Close()
+
+	revocations = authclient.NewRevocations(feed.URL, http.DefaultClient)
+	defer func() { revocations = nil }()
+	if err := revocations.Refresh(); err != nil {
+		log.Printf("Failed to read revocation feed : %s", err)
+		t.FailNow()
+	}
+
+	roster.AddShift(shift{ID: "morning", Username: "sebvet", Start: now.Add(-time.Minute), End: now.Add(time.Hour), Rate: 9, PlannedAt: now.Add(-time.Hour)}, maxShifts)
+	roster.AddShift(shift{ID: "later", Username: "sebvet", Start: now.Add(2 * time.Hour), End: now.Add(3 * time.Hour), Rate: 9, PlannedAt: now.Add(-time.Hour)}, maxShifts)
+	roster.AddShift(shift{ID: "evening", Username: "babydriver", Start: now.Add(-time.Minute), End: now.Add(time.Hour), Rate: 7, PlannedAt: now.Add(-time.Minute)}, maxShifts)
+
+	runShifts(now)
+
+	if _, err := roster.Get("sebvet"); err != ErrNotInRoster {
+		log.Println("Failed to keep revoked driver off the roster")
+		t.Fail()
+	}
+
+	if d, err := roster.Get("babydriver"); err != nil || d.ShiftID != "evening" {
+		log.Println("Failed to start shift planned after revocation")
+		t.Fail()
+	}
+
+	if shifts, _ := roster.Shifts("sebvet"); len(shifts) != 0 {
+		log.Printf("Failed to drop shifts of revoked driver, got %v", shifts)
+		t.Fail()
+	}
+}
+
+// Plans overlapping shifts for one driver from many goroutines at once. Only one of them may be added.
+func checkConcurrentShifts(t *testing.T, store ShiftStore) {
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	results := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := now.Add(time.Duration(i) * time.Minute)
+			results <- store.AddShift(shift{ID: string(rune('a' + i)), Username: "sebvet", Start: start, End: start.Add(time.Hour), Rate: 9}, maxShifts)
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	added := 0
+	for err := range results {
+		if err == nil {
+			added++
+		} else if err != ErrShiftOverlaps {
+			log.Printf("Failed to add shift : %s", err)
+			t.Fail()
+		}
+	}
+
+	if shifts, _ := store.Shifts("sebvet"); added != 1 || len(shifts) != 1 {
+		log.Printf("Failed to refuse overlapping shifts, added %d", added)
+		t.Fail()
+	}
+
+	// The limit is checked in the same way
+	later := now.Add(2 * time.Hour)
+	if err := store.AddShift(shift{ID: "later", Username: "sebvet", Start: later, End: later.Add(time.Hour), Rate: 9}, 1); err != ErrTooManyShifts {
+		log.Printf("Failed to refuse shift over the limit, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestMemoryRosterStoreShifts(t *testing.T) {
+	checkConcurrentShifts(t, newMemoryRosterStore())
+}
+
+func TestBoltRosterStoreShifts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roster")
+	if err != nil {
+		log.Printf("Failed to create temporary directory : %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newBoltRosterStore(filepath.Join(dir, "roster.db"))
+	if err != nil {
+		log.Printf("Failed to open bolt roster store : %s", err)
+		t.FailNow()
+	}
+	defer store.db.Close()
+
+	checkConcurrentShifts(t, store)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// States a driver in the roster can be in. Only available drivers are offered to riders.
+const (
+	stateAvailable = "available"
+	stateOnTrip    = "on_trip"
+	stateOnBreak   = "on_break"
+	stateOffline   = "offline"
+)
+
+// Drivers who have not sent a heartbeat for this long are moved to offline. Overridden by HEARTBEAT_TIMEOUT.
+const defaultHeartbeatTimeout = 90 * time.Second
+
+var heartbeatTimeout = defaultHeartbeatTimeout
+
+// The states a driver may move to from each state. Any state can also move to offline through the sweeper.
+var stateTransitions = map[string][]string{
+	stateAvailable: {stateOnTrip, stateOnBreak, stateOffline},
+	stateOnTrip:    {stateAvailable, stateOffline},
+	stateOnBreak:   {stateAvailable, stateOffline},
+	stateOffline:   {stateAvailable},
+}
+
+type invalidTransitionError struct {
+	from, to string
+}
+
+func (e invalidTransitionError) Error() string {
+	return fmt.Sprintf("cannot change state from %s to %s", e.from, e.to)
+}
+
+type driverStateRequest struct {
+	State string `json:"state"`
+}
+
+func validState(state string) bool {
+	_, ok := stateTransitions[state]
+	return ok
+}
+
+// Reports whether a driver may move from one state to another. Staying in the same state is always allowed.
+func canTransition(from, to string) bool {
+	if from == to {
+		return true
+	}
+	for _, allowed := range stateTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Requires authentication as a driver in the roster.
+func changeState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Printf("Error: Parsing request to change state failed : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Parsing request to change state failed\"}"))
+		return
+	}
+
+	var requestData driverStateRequest
+	err = json.Unmarshal(body, &requestData)
+
+	if err != nil || !validState(requestData.State) {
+		log.Println("Error: Invalid state supplied.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"State must be one of available, on_trip, on_break or offline\"}"))
+		return
+	}
+
+	user := authenticatedDriver(r)
+
+	now := time.Now()
+	var tripStarted *time.Time
+	rosterUser, err := roster.Update(user.Username, func(d *driver) error {
+		if !canTransition(d.State, requestData.State) {
+			return invalidTransitionError{from: d.State, to: requestData.State}
+		}
+		tripStarted = trackTrip(d, requestData.State, now)
+		d.State = requestData.State
+		// Changing state shows the driver's app is still running
+		d.LastHeartbeat = now
+		return nil
+	})
+
+	if err == ErrNotInRoster {
+		log.Println("Error: User is not in roster.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"User is not in roster\"}"))
+		return
+	}
+
+	if transitionErr, ok := err.(invalidTransitionError); ok {
+		log.Printf("Error: User %s %s", user.Username, transitionErr)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("{\"error\": \"Cannot change state from %s to %s\"}", transitionErr.from, transitionErr.to)))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not change state for user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not change state\"}"))
+		return
+	}
+
+	if tripStarted != nil {
+		recordWork(rosterUser.Username, workOnTrip, *tripStarted, now)
+	}
+
+	// Drivers who go offline should not turn up in nearby searches while their last position is still fresh
+	if rosterUser.State == stateOffline {
+		locations.remove(rosterUser.Username)
+	}
+
+	events.publish(rosterEvent{Type: eventStateChanged, Username: rosterUser.Username, At: now, Driver: &rosterUser})
+	log.Printf("User %s is now %s.", rosterUser.Username, rosterUser.State)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rosterUser)
+}
+
+// Requires authentication as a driver in the roster. No body is needed.
+// Tells Roster that the driver's app is still running. It does not bring an offline driver back;
+// the driver has to set their state to available again.
+func heartbeat(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user := authenticatedDriver(r)
+
+	rosterUser, err := roster.Update(user.Username, func(d *driver) error {
+		d.LastHeartbeat = time.Now()
+		return nil
+	})
+
+	if err == ErrNotInRoster {
+		log.Println("Error: User is not in roster.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"User is not in roster\"}"))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not record heartbeat for user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not record heartbeat\"}"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rosterUser)
+}
+
+// Starts or stops timing the driver's trip as they move to a new state. Returns when the trip started if this ends it,
+// so that the caller can record it once the change is stored.
+func trackTrip(d *driver, to string, now time.Time) *time.Time {
+	started := d.TripStartedAt
+	switch {
+	case d.State != stateOnTrip && to == stateOnTrip:
+		d.TripStartedAt = &now
+	case d.State == stateOnTrip && to != stateOnTrip:
+		d.TripStartedAt = nil
+		return started
+	}
+	return nil
+}
+
+var errHeartbeatFresh = errors.New("heartbeat received since sweep started")
+
+// Moves drivers who have missed their heartbeats to offline.
+func sweepMissedHeartbeats(timeout time.Duration) {
+	drivers, err := roster.List()
+	if err != nil {
+		log.Printf("Error: Could not read roster to sweep missed heartbeats : %s", err)
+		return
+	}
+
+	for _, d := range drivers {
+		if d.State == stateOffline || time.Since(d.LastHeartbeat) <= timeout {
+			continue
+		}
+
+		// Checked again inside the update, in case a heartbeat arrived since the roster was listed
+		now := time.Now()
+		var tripStarted *time.Time
+		offline, err := roster.Update(d.Username, func(d *driver) error {
+			if time.Since(d.LastHeartbeat) <= timeout {
+				return errHeartbeatFresh
+			}
+			tripStarted = trackTrip(d, stateOffline, now)
+			d.State = stateOffline
+			return nil
+		})
+
+		if err == ErrNotInRoster || err == errHeartbeatFresh {
+			continue
+		}
+
+		if err != nil {
+			log.Printf("Error: Could not move user %s offline : %s", d.Username, err)
+			continue
+		}
+
+		if tripStarted != nil {
+			recordWork(d.Username, workOnTrip, *tripStarted, now)
+		}
+
+		locations.remove(d.Username)
+		events.publish(rosterEvent{Type: eventStateChanged, Username: d.Username, At: now, Driver: &offline, Reason: reasonMissedHeartbeats})
+		log.Printf("User %s missed heartbeats and is now offline.", d.Username)
+	}
+}
+
+func sweepEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		sweepMissedHeartbeats(heartbeatTimeout)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"testing"
+	"time"
+)
+
+func TestStateTransitions(t *testing.T) {
+	allowed := [][2]string{
+		{stateAvailable, stateOnTrip},
+		{stateOnTrip, stateAvailable},
+		{stateAvailable, stateOnBreak},
+		{stateOnBreak, stateOffline},
+		{stateOffline, stateAvailable},
+		{stateOnBreak, stateOnBreak},
+	}
+	for _, transition := range allowed {
+		if !canTransition(transition[0], transition[1]) {
+			log.Printf("Failed to allow state change from %s to %s", transition[0], transition[1])
+			t.Fail()
+		}
+	}
+
+	refused := [][2]string{
+		{stateOnTrip, stateOnBreak},
+		{stateOffline, stateOnTrip},
+		{stateOnBreak, stateOnTrip},
+	}
+	for _, transition := range refused {
+		if canTransition(transition[0], transition[1]) {
+			log.Printf("Failed to refuse state change from %s to %s", transition[0], transition[1])
+			t.Fail()
+		}
+	}
+}
+
+func TestSweepMissedHeartbeats(t *testing.T) {
+	roster = newMemoryRosterStore()
+	now := time.Now()
+
+	roster.Join(driver{Username: "quiet", Rate: 5, State: stateOnTrip, LastHeartbeat: now.Add(-2 * time.Minute)})
+	roster.Join(driver{Username: "chatty", Rate: 5, State: stateAvailable, LastHeartbeat: now})
+	locations.update("quiet", position{Lat: 51.5031, Lng: -0.1132, Timestamp: now})
+
+	sweepMissedHeartbeats(time.Minute)
+
+	if quiet, _ := roster.Get("quiet"); quiet.State != stateOffline {
+		log.Printf("Failed to move driver who missed heartbeats offline, state is %s", quiet.State)
+		t.Fail()
+	}
+
+	if chatty, _ := roster.Get("chatty"); chatty.State != stateAvailable {
+		log.Printf("Failed to leave driver with recent heartbeat alone, state is %s", chatty.State)
+		t.Fail()
+	}
+
+	if len(locations.nearby(51.5031, -0.1132, 1)) != 0 {
+		log.Println("Failed to forget location of driver moved offline")
+		t.Fail()
+	}
+}
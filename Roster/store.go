@@ -0,0 +1,516 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrNotInRoster = errors.New("driver is not in roster")
+var ErrAlreadyInRoster = errors.New("driver is already in roster")
+var ErrVehicleExists = errors.New("vehicle is already registered")
+var ErrVehicleNotFound = errors.New("vehicle not found")
+var ErrVehicleInUse = errors.New("vehicle is in use in the roster")
+var ErrScheduleNotFound = errors.New("scheduled rate not found")
+var ErrZoneNotFound = errors.New("zone not found")
+var ErrShiftNotFound = errors.New("shift not found")
+var ErrShiftOverlaps = errors.New("shift overlaps another shift")
+var ErrTooManyShifts = errors.New("too many shifts planned")
+
+// RosterStore holds the drivers currently in the roster, and everything else Roster keeps about every
+// driver, whether or not they are in it. Implementations must be safe for concurrent use.
+type RosterStore interface {
+	DriverStore
+	RateStore
+	ZoneStore
+	ShiftStore
+}
+
+// DriverStore holds the drivers in the roster and the vehicles each driver has registered.
+type DriverStore interface {
+	Get(username string) (driver, error)
+	// Join adds a driver, returning ErrAlreadyInRoster if they are already in the roster.
+	Join(d driver) error
+	// Leave removes a driver and returns their record, or ErrNotInRoster if they are not in the roster.
+	Leave(username string) (driver, error)
+	// LeaveIf is like Leave, but first passes the driver's record to check. If check returns an error,
+	// the driver stays in the roster and that error is returned. The check and removal happen atomically.
+	LeaveIf(username string, check func(driver) error) (driver, error)
+	// Update applies change to the driver's record and stores the result, returning ErrNotInRoster if
+	// they are not in the roster. The read and write happen atomically. If change returns an error,
+	// nothing is stored and that error is returned.
+	Update(username string, change func(*driver) error) (driver, error)
+	// List returns every driver in the roster, ordered by username.
+	List() ([]driver, error)
+
+	// Vehicles returns the vehicles the driver has registered, ordered by registration.
+	Vehicles(username string) ([]vehicle, error)
+	// AddVehicle registers a vehicle, returning ErrVehicleExists if the driver already has one with its registration.
+	AddVehicle(username string, v vehicle) error
+	// RemoveVehicle returns ErrVehicleNotFound if the driver has no such vehicle, and ErrVehicleInUse
+	// if they are in the roster with it.
+	RemoveVehicle(username, registration string) error
+}
+
+// RateStore holds each driver's rate history, scheduled rate changes and rate profile.
+type RateStore interface {
+	// RateHistory returns every rate the driver has set, oldest first.
+	RateHistory(username string) ([]rateChange, error)
+	// RecordRate adds a change to the end of the driver's rate history.
+	RecordRate(username string, change rateChange) error
+	// ScheduledRates returns the driver's scheduled rate changes, soonest first.
+	ScheduledRates(username string) ([]scheduledRate, error)
+	ScheduleRate(change scheduledRate) error
+	// CancelScheduledRate returns ErrScheduleNotFound if the driver has no scheduled change with that id.
+	CancelScheduledRate(username, id string) error
+	// TakeDueRates removes and returns every scheduled change due at or before now, soonest first.
+	TakeDueRates(now time.Time) ([]scheduledRate, error)
+
+	// RateProfile returns the driver's rate profile, which is empty if they have not set one.
+	RateProfile(username string) (rateProfile, error)
+	SetRateProfile(username string, p rateProfile) error
+}
+
+// ZoneStore holds the city zones and the area each driver works in.
+type ZoneStore interface {
+	// Area returns the area the driver works in, which is empty if they have not set one.
+	Area(username string) (driverArea, error)
+	SetArea(username string, area driverArea) error
+	// Zones returns the city zones, ordered by id.
+	Zones() ([]cityZone, error)
+	// Zone returns ErrZoneNotFound if there is no zone with that id.
+	Zone(id string) (cityZone, error)
+	// PutZone creates the zone, or replaces the one with the same id.
+	PutZone(zone cityZone) error
+	// DeleteZone returns ErrZoneNotFound if there is no zone with that id.
+	DeleteZone(id string) error
+}
+
+// ShiftStore holds each driver's planned shifts and recent working hours.
+type ShiftStore interface {
+	// Shifts returns the driver's planned shifts, soonest first.
+	Shifts(username string) ([]shift, error)
+	// AllShifts returns every driver's shifts, soonest first.
+	AllShifts() ([]shift, error)
+	// AddShift adds the shift, returning ErrTooManyShifts if the driver already has limit planned and
+	// ErrShiftOverlaps if it overlaps one of them. The checks and the write happen atomically.
+	AddShift(s shift, limit int) error
+	// UpdateShift applies change to the shift and stores the result atomically, returning ErrShiftNotFound if
+	// the driver has no shift with that id, e.g. because it was cancelled. If change returns an error,
+	// nothing is stored and that error is returned.
+	UpdateShift(username, id string, change func(*shift) error) (shift, error)
+	// CancelShift returns ErrShiftNotFound if the driver has no shift with that id.
+	CancelShift(username, id string) error
+	// Hours returns the driver's recent working time and any mandatory break.
+	Hours(username string) (driverHours, error)
+	// UpdateHours applies change to the driver's hours and stores the result atomically.
+	UpdateHours(username string, change func(*driverHours)) error
+}
+
+// Keeps the roster in a map. Everything is lost when the service restarts.
+type memoryRosterStore struct {
+	mutex   sync.RWMutex
+	drivers map[string]driver
+	// Username to registration to vehicle.
+	vehicles map[string]map[string]vehicle
+	history  map[string][]rateChange
+	// Schedule id to change.
+	scheduled map[string]scheduledRate
+	profiles  map[string]rateProfile
+	areas     map[string]driverArea
+	zones     map[string]cityZone
+	// Shift id to shift.
+	shifts map[string]shift
+	hours  map[string]driverHours
+}
+
+func newMemoryRosterStore() *memoryRosterStore {
+	return &memoryRosterStore{
+		drivers:   map[string]driver{},
+		vehicles:  map[string]map[string]vehicle{},
+		history:   map[string][]rateChange{},
+		scheduled: map[string]scheduledRate{},
+		profiles:  map[string]rateProfile{},
+		areas:     map[string]driverArea{},
+		zones:     map[string]cityZone{},
+		shifts:    map[string]shift{},
+		hours:     map[string]driverHours{},
+	}
+}
+
+func (s *memoryRosterStore) Get(username string) (driver, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	d, ok := s.drivers[username]
+	if !ok {
+		return driver{}, ErrNotInRoster
+	}
+	return d, nil
+}
+
+func (s *memoryRosterStore) Join(d driver) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.drivers[d.Username]; ok {
+		return ErrAlreadyInRoster
+	}
+	s.drivers[d.Username] = d
+	return nil
+}
+
+func (s *memoryRosterStore) Leave(username string) (driver, error) {
+	return s.LeaveIf(username, func(driver) error { return nil })
+}
+
+func (s *memoryRosterStore) LeaveIf(username string, check func(driver) error) (driver, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	d, ok := s.drivers[username]
+	if !ok {
+		return driver{}, ErrNotInRoster
+	}
+	if err := check(d); err != nil {
+		return driver{}, err
+	}
+	delete(s.drivers, username)
+	return d, nil
+}
+
+func (s *memoryRosterStore) Update(username string, change func(*driver) error) (driver, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	d, ok := s.drivers[username]
+	if !ok {
+		return driver{}, ErrNotInRoster
+	}
+	if err := change(&d); err != nil {
+		return driver{}, err
+	}
+	s.drivers[username] = d
+	return d, nil
+}
+
+func (s *memoryRosterStore) List() ([]driver, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	drivers := make([]driver, 0, len(s.drivers))
+	for _, d := range s.drivers {
+		drivers = append(drivers, d)
+	}
+	sort.Slice(drivers, func(i, j int) bool { return drivers[i].Username < drivers[j].Username })
+	return drivers, nil
+}
+
+func (s *memoryRosterStore) Vehicles(username string) ([]vehicle, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	vehicles := make([]vehicle, 0, len(s.vehicles[username]))
+	for _, v := range s.vehicles[username] {
+		vehicles = append(vehicles, v)
+	}
+	sort.Slice(vehicles, func(i, j int) bool { return vehicles[i].Registration < vehicles[j].Registration })
+	return vehicles, nil
+}
+
+func (s *memoryRosterStore) AddVehicle(username string, v vehicle) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.vehicles[username][v.Registration]; ok {
+		return ErrVehicleExists
+	}
+	if s.vehicles[username] == nil {
+		s.vehicles[username] = map[string]vehicle{}
+	}
+	s.vehicles[username][v.Registration] = v
+	return nil
+}
+
+func (s *memoryRosterStore) RemoveVehicle(username, registration string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.vehicles[username][registration]; !ok {
+		return ErrVehicleNotFound
+	}
+	if d, ok := s.drivers[username]; ok && d.Vehicle != nil && d.Vehicle.Registration == registration {
+		return ErrVehicleInUse
+	}
+	delete(s.vehicles[username], registration)
+	return nil
+}
+
+func (s *memoryRosterStore) RateHistory(username string) ([]rateChange, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]rateChange{}, s.history[username]...), nil
+}
+
+func (s *memoryRosterStore) RecordRate(username string, change rateChange) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.history[username] = append(s.history[username], change)
+	return nil
+}
+
+func (s *memoryRosterStore) ScheduledRates(username string) ([]scheduledRate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	scheduled := []scheduledRate{}
+	for _, change := range s.scheduled {
+		if change.Username == username {
+			scheduled = append(scheduled, change)
+		}
+	}
+	sortScheduledRates(scheduled)
+	return scheduled, nil
+}
+
+func (s *memoryRosterStore) ScheduleRate(change scheduledRate) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.scheduled[change.ID] = change
+	return nil
+}
+
+func (s *memoryRosterStore) CancelScheduledRate(username, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if change, ok := s.scheduled[id]; !ok || change.Username != username {
+		return ErrScheduleNotFound
+	}
+	delete(s.scheduled, id)
+	return nil
+}
+
+func (s *memoryRosterStore) TakeDueRates(now time.Time) ([]scheduledRate, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	due := []scheduledRate{}
+	for id, change := range s.scheduled {
+		if !change.At.After(now) {
+			due = append(due, change)
+			delete(s.scheduled, id)
+		}
+	}
+	sortScheduledRates(due)
+	return due, nil
+}
+
+func (s *memoryRosterStore) RateProfile(username string) (rateProfile, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	p, ok := s.profiles[username]
+	if !ok {
+		return rateProfile{Weekly: []rateWindow{}, Overrides: []rateOverride{}}, nil
+	}
+	return p, nil
+}
+
+func (s *memoryRosterStore) SetRateProfile(username string, p rateProfile) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.profiles[username] = p
+	return nil
+}
+
+func (s *memoryRosterStore) Area(username string) (driverArea, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.areas[username], nil
+}
+
+func (s *memoryRosterStore) SetArea(username string, area driverArea) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.areas[username] = area
+	return nil
+}
+
+func (s *memoryRosterStore) Zones() ([]cityZone, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	zones := make([]cityZone, 0, len(s.zones))
+	for _, zone := range s.zones {
+		zones = append(zones, zone)
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].ID < zones[j].ID })
+	return zones, nil
+}
+
+func (s *memoryRosterStore) Zone(id string) (cityZone, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	zone, ok := s.zones[id]
+	if !ok {
+		return cityZone{}, ErrZoneNotFound
+	}
+	return zone, nil
+}
+
+func (s *memoryRosterStore) PutZone(zone cityZone) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.zones[zone.ID] = zone
+	return nil
+}
+
+func (s *memoryRosterStore) DeleteZone(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.zones[id]; !ok {
+		return ErrZoneNotFound
+	}
+	delete(s.zones, id)
+	return nil
+}
+
+func (s *memoryRosterStore) Shifts(username string) ([]shift, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	shifts := []shift{}
+	for _, planned := range s.shifts {
+		if planned.Username == username {
+			shifts = append(shifts, planned)
+		}
+	}
+	sortShifts(shifts)
+	return shifts, nil
+}
+
+func (s *memoryRosterStore) AllShifts() ([]shift, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	shifts := make([]shift, 0, len(s.shifts))
+	for _, planned := range s.shifts {
+		shifts = append(shifts, planned)
+	}
+	sortShifts(shifts)
+	return shifts, nil
+}
+
+func (s *memoryRosterStore) AddShift(planned shift, limit int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing := []shift{}
+	for _, other := range s.shifts {
+		existing = append(existing, other)
+	}
+	if err := checkNewShift(existing, planned, limit); err != nil {
+		return err
+	}
+	s.shifts[planned.ID] = planned
+	return nil
+}
+
+func (s *memoryRosterStore) UpdateShift(username, id string, change func(*shift) error) (shift, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	planned, ok := s.shifts[id]
+	if !ok || planned.Username != username {
+		return shift{}, ErrShiftNotFound
+	}
+	if err := change(&planned); err != nil {
+		return shift{}, err
+	}
+	s.shifts[id] = planned
+	return planned, nil
+}
+
+func (s *memoryRosterStore) CancelShift(username, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if planned, ok := s.shifts[id]; !ok || planned.Username != username {
+		return ErrShiftNotFound
+	}
+	delete(s.shifts, id)
+	return nil
+}
+
+func (s *memoryRosterStore) Hours(username string) (driverHours, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	h := s.hours[username]
+	h.Periods = append([]workPeriod{}, h.Periods...)
+	return h, nil
+}
+
+func (s *memoryRosterStore) UpdateHours(username string, change func(*driverHours)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	h := s.hours[username]
+	h.Periods = append([]workPeriod{}, h.Periods...)
+	change(&h)
+	s.hours[username] = h
+	return nil
+}
+
+// Returns ErrTooManyShifts or ErrShiftOverlaps if planned cannot be added alongside existing, which may
+// include other drivers' shifts.
+func checkNewShift(existing []shift, planned shift, limit int) error {
+	count := 0
+	for _, other := range existing {
+		if other.Username != planned.Username {
+			continue
+		}
+		count++
+		if other.Start.Before(planned.End) && planned.Start.Before(other.End) {
+			return ErrShiftOverlaps
+		}
+	}
+	if count >= limit {
+		return ErrTooManyShifts
+	}
+	return nil
+}
+
+func sortShifts(shifts []shift) {
+	sort.Slice(shifts, func(i, j int) bool { return shifts[i].Start.Before(shifts[j].Start) })
+}
+
+func sortScheduledRates(scheduled []scheduledRate) {
+	sort.Slice(scheduled, func(i, j int) bool { return scheduled[i].At.Before(scheduled[j].At) })
+}
+
+// Builds the roster store selected by ROSTER_STORE ("memory" or "bolt").
+func newRosterStore() (RosterStore, error) {
+	kind := os.Getenv("ROSTER_STORE")
+	if kind == "" {
+		kind = "memory"
+	}
+
+	switch kind {
+	case "memory":
+		return newMemoryRosterStore(), nil
+	case "bolt":
+		path := os.Getenv("ROSTER_DB_PATH")
+		if path == "" {
+			path = "roster.db"
+		}
+		return newBoltRosterStore(path)
+	default:
+		return nil, errors.New("unknown ROSTER_STORE " + kind)
+	}
+}
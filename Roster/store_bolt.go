@@ -0,0 +1,564 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var rosterBucket = []byte("roster")
+
+// Each driver's vehicles are kept as one record, keyed by username. So are their rate history, rate profile,
+// operating area and working hours.
+var vehiclesBucket = []byte("vehicles")
+var rateHistoryBucket = []byte("rate_history")
+var rateProfilesBucket = []byte("rate_profiles")
+var areasBucket = []byte("areas")
+var hoursBucket = []byte("hours")
+
+// Shifts, keyed by id.
+var shiftsBucket = []byte("shifts")
+
+// City zones, keyed by id.
+var zonesBucket = []byte("zones")
+
+// Scheduled rate changes, keyed by id.
+var scheduledRatesBucket = []byte("scheduled_rates")
+
+// Keeps the roster in a BoltDB file so that drivers stay in it across restarts.
+// Records are stored as JSON, the same as the API returns them.
+type boltRosterStore struct {
+	db *bolt.DB
+}
+
+func newBoltRosterStore(path string) (*boltRosterStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{rosterBucket, vehiclesBucket, rateHistoryBucket, scheduledRatesBucket, rateProfilesBucket, areasBucket, zonesBucket, shiftsBucket, hoursBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltRosterStore{db: db}, nil
+}
+
+func (s *boltRosterStore) Get(username string) (driver, error) {
+	var d driver
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(rosterBucket).Get([]byte(username))
+		if data == nil {
+			return ErrNotInRoster
+		}
+		return json.Unmarshal(data, &d)
+	})
+	return d, err
+}
+
+func (s *boltRosterStore) Join(d driver) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(rosterBucket)
+		if bucket.Get([]byte(d.Username)) != nil {
+			return ErrAlreadyInRoster
+		}
+		return putDriver(bucket, d)
+	})
+}
+
+func (s *boltRosterStore) Leave(username string) (driver, error) {
+	return s.LeaveIf(username, func(driver) error { return nil })
+}
+
+func (s *boltRosterStore) LeaveIf(username string, check func(driver) error) (driver, error) {
+	var d driver
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(rosterBucket)
+		data := bucket.Get([]byte(username))
+		if data == nil {
+			return ErrNotInRoster
+		}
+		if err := json.Unmarshal(data, &d); err != nil {
+			return err
+		}
+		if err := check(d); err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(username))
+	})
+	if err != nil {
+		return driver{}, err
+	}
+	return d, nil
+}
+
+// Bolt allows one read-write transaction at a time, which is what makes the update atomic.
+func (s *boltRosterStore) Update(username string, change func(*driver) error) (driver, error) {
+	var d driver
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(rosterBucket)
+		data := bucket.Get([]byte(username))
+		if data == nil {
+			return ErrNotInRoster
+		}
+		if err := json.Unmarshal(data, &d); err != nil {
+			return err
+		}
+		if err := change(&d); err != nil {
+			return err
+		}
+		return putDriver(bucket, d)
+	})
+	if err != nil {
+		return driver{}, err
+	}
+	return d, nil
+}
+
+// Bolt keeps keys in byte order, so the drivers come out ordered by username.
+func (s *boltRosterStore) List() ([]driver, error) {
+	drivers := []driver{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(rosterBucket).ForEach(func(_, data []byte) error {
+			var d driver
+			if err := json.Unmarshal(data, &d); err != nil {
+				return err
+			}
+			drivers = append(drivers, d)
+			return nil
+		})
+	})
+	return drivers, err
+}
+
+func (s *boltRosterStore) Vehicles(username string) ([]vehicle, error) {
+	vehicles := []vehicle{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		vehicles, err = getVehicles(tx.Bucket(vehiclesBucket), username)
+		return err
+	})
+	return vehicles, err
+}
+
+func (s *boltRosterStore) AddVehicle(username string, v vehicle) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(vehiclesBucket)
+		vehicles, err := getVehicles(bucket, username)
+		if err != nil {
+			return err
+		}
+
+		for _, existing := range vehicles {
+			if existing.Registration == v.Registration {
+				return ErrVehicleExists
+			}
+		}
+
+		vehicles = append(vehicles, v)
+		sort.Slice(vehicles, func(i, j int) bool { return vehicles[i].Registration < vehicles[j].Registration })
+		return putVehicles(bucket, username, vehicles)
+	})
+}
+
+func (s *boltRosterStore) RemoveVehicle(username, registration string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(vehiclesBucket)
+		vehicles, err := getVehicles(bucket, username)
+		if err != nil {
+			return err
+		}
+
+		for i, v := range vehicles {
+			if v.Registration != registration {
+				continue
+			}
+
+			if data := tx.Bucket(rosterBucket).Get([]byte(username)); data != nil {
+				var d driver
+				if err := json.Unmarshal(data, &d); err != nil {
+					return err
+				}
+				if d.Vehicle != nil && d.Vehicle.Registration == registration {
+					return ErrVehicleInUse
+				}
+			}
+			return putVehicles(bucket, username, append(vehicles[:i], vehicles[i+1:]...))
+		}
+		return ErrVehicleNotFound
+	})
+}
+
+func (s *boltRosterStore) RateHistory(username string) ([]rateChange, error) {
+	history := []rateChange{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(rateHistoryBucket).Get([]byte(username))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &history)
+	})
+	return history, err
+}
+
+func (s *boltRosterStore) RecordRate(username string, change rateChange) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(rateHistoryBucket)
+		history := []rateChange{}
+		if data := bucket.Get([]byte(username)); data != nil {
+			if err := json.Unmarshal(data, &history); err != nil {
+				return err
+			}
+		}
+
+		data, err := json.Marshal(append(history, change))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(username), data)
+	})
+}
+
+func (s *boltRosterStore) ScheduledRates(username string) ([]scheduledRate, error) {
+	scheduled := []scheduledRate{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(scheduledRatesBucket).ForEach(func(_, data []byte) error {
+			var change scheduledRate
+			if err := json.Unmarshal(data, &change); err != nil {
+				return err
+			}
+			if change.Username == username {
+				scheduled = append(scheduled, change)
+			}
+			return nil
+		})
+	})
+	sortScheduledRates(scheduled)
+	return scheduled, err
+}
+
+func (s *boltRosterStore) ScheduleRate(change scheduledRate) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(scheduledRatesBucket).Put([]byte(change.ID), data)
+	})
+}
+
+func (s *boltRosterStore) CancelScheduledRate(username, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scheduledRatesBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return ErrScheduleNotFound
+		}
+
+		var change scheduledRate
+		if err := json.Unmarshal(data, &change); err != nil {
+			return err
+		}
+		if change.Username != username {
+			return ErrScheduleNotFound
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (s *boltRosterStore) TakeDueRates(now time.Time) ([]scheduledRate, error) {
+	due := []scheduledRate{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(scheduledRatesBucket)
+		err := bucket.ForEach(func(_, data []byte) error {
+			var change scheduledRate
+			if err := json.Unmarshal(data, &change); err != nil {
+				return err
+			}
+			if !change.At.After(now) {
+				due = append(due, change)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Bolt does not allow deleting while iterating with ForEach
+		for _, change := range due {
+			if err := bucket.Delete([]byte(change.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortScheduledRates(due)
+	return due, nil
+}
+
+func (s *boltRosterStore) RateProfile(username string) (rateProfile, error) {
+	p := rateProfile{Weekly: []rateWindow{}, Overrides: []rateOverride{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(rateProfilesBucket).Get([]byte(username))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &p)
+	})
+	return p, err
+}
+
+func (s *boltRosterStore) SetRateProfile(username string, p rateProfile) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(rateProfilesBucket).Put([]byte(username), data)
+	})
+}
+
+func (s *boltRosterStore) Area(username string) (driverArea, error) {
+	var area driverArea
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(areasBucket).Get([]byte(username))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &area)
+	})
+	return area, err
+}
+
+func (s *boltRosterStore) SetArea(username string, area driverArea) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(area)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(areasBucket).Put([]byte(username), data)
+	})
+}
+
+func (s *boltRosterStore) Zones() ([]cityZone, error) {
+	zones := []cityZone{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(zonesBucket).ForEach(func(_, data []byte) error {
+			var zone cityZone
+			if err := json.Unmarshal(data, &zone); err != nil {
+				return err
+			}
+			zones = append(zones, zone)
+			return nil
+		})
+	})
+	return zones, err
+}
+
+func (s *boltRosterStore) Zone(id string) (cityZone, error) {
+	var zone cityZone
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(zonesBucket).Get([]byte(id))
+		if data == nil {
+			return ErrZoneNotFound
+		}
+		return json.Unmarshal(data, &zone)
+	})
+	return zone, err
+}
+
+func (s *boltRosterStore) PutZone(zone cityZone) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(zone)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(zonesBucket).Put([]byte(zone.ID), data)
+	})
+}
+
+func (s *boltRosterStore) DeleteZone(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(zonesBucket)
+		if bucket.Get([]byte(id)) == nil {
+			return ErrZoneNotFound
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (s *boltRosterStore) Shifts(username string) ([]shift, error) {
+	shifts, err := s.AllShifts()
+	if err != nil {
+		return nil, err
+	}
+
+	own := []shift{}
+	for _, planned := range shifts {
+		if planned.Username == username {
+			own = append(own, planned)
+		}
+	}
+	return own, nil
+}
+
+func (s *boltRosterStore) AllShifts() ([]shift, error) {
+	var shifts []shift
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		shifts, err = getShifts(tx.Bucket(shiftsBucket))
+		return err
+	})
+	sortShifts(shifts)
+	return shifts, err
+}
+
+func (s *boltRosterStore) AddShift(planned shift, limit int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(shiftsBucket)
+		existing, err := getShifts(bucket)
+		if err != nil {
+			return err
+		}
+		if err := checkNewShift(existing, planned, limit); err != nil {
+			return err
+		}
+		return putShift(bucket, planned)
+	})
+}
+
+func (s *boltRosterStore) UpdateShift(username, id string, change func(*shift) error) (shift, error) {
+	var planned shift
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(shiftsBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return ErrShiftNotFound
+		}
+		if err := json.Unmarshal(data, &planned); err != nil {
+			return err
+		}
+		if planned.Username != username {
+			return ErrShiftNotFound
+		}
+		if err := change(&planned); err != nil {
+			return err
+		}
+		return putShift(bucket, planned)
+	})
+	if err != nil {
+		return shift{}, err
+	}
+	return planned, nil
+}
+
+func (s *boltRosterStore) CancelShift(username, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(shiftsBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return ErrShiftNotFound
+		}
+
+		var planned shift
+		if err := json.Unmarshal(data, &planned); err != nil {
+			return err
+		}
+		if planned.Username != username {
+			return ErrShiftNotFound
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (s *boltRosterStore) Hours(username string) (driverHours, error) {
+	var h driverHours
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(hoursBucket).Get([]byte(username))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &h)
+	})
+	return h, err
+}
+
+func (s *boltRosterStore) UpdateHours(username string, change func(*driverHours)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(hoursBucket)
+		var h driverHours
+		if data := bucket.Get([]byte(username)); data != nil {
+			if err := json.Unmarshal(data, &h); err != nil {
+				return err
+			}
+		}
+
+		change(&h)
+		data, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(username), data)
+	})
+}
+
+func getVehicles(bucket *bolt.Bucket, username string) ([]vehicle, error) {
+	vehicles := []vehicle{}
+	data := bucket.Get([]byte(username))
+	if data == nil {
+		return vehicles, nil
+	}
+	err := json.Unmarshal(data, &vehicles)
+	return vehicles, err
+}
+
+func putVehicles(bucket *bolt.Bucket, username string, vehicles []vehicle) error {
+	data, err := json.Marshal(vehicles)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(username), data)
+}
+
+func getShifts(bucket *bolt.Bucket) ([]shift, error) {
+	shifts := []shift{}
+	err := bucket.ForEach(func(_, data []byte) error {
+		var planned shift
+		if err := json.Unmarshal(data, &planned); err != nil {
+			return err
+		}
+		shifts = append(shifts, planned)
+		return nil
+	})
+	return shifts, err
+}
+
+func putShift(bucket *bolt.Bucket, planned shift) error {
+	data, err := json.Marshal(planned)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(planned.ID), data)
+}
+
+func putDriver(bucket *bolt.Bucket, d driver) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(d.Username), data)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matt-drayton/easy-ride/Shared/authclient"
+)
+
+// Calls a roster handler directly, as if requireDriver had accepted a token for username.
+func driverRequest(handler http.HandlerFunc, method, username, body string) int {
+	req := httptest.NewRequest(method, "/roster", strings.NewReader(body))
+	claims := &authclient.Claims{Username: username, Name: username, Roles: []string{authclient.RoleDriver}}
+	req = req.WithContext(authclient.WithClaims(req.Context(), claims))
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, req)
+	return recorder.Code
+}
+
+// Joins, leaves and changes rate for a handful of drivers from many goroutines at once.
+// Run with -race. Afterwards each driver must be in the roster exactly when they joined once more than they left.
+func hammerRoster(t *testing.T, store RosterStore) {
+	roster = store
+
+	const drivers = 4
+	const workers = 8
+	const rounds = 50
+
+	var mutex sync.Mutex
+	joined := map[string]int{}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				username := fmt.Sprintf("driver%d", (w+i)%drivers)
+
+				switch i % 4 {
+				case 0:
+					if driverRequest(joinRoster, "POST", username, "{\"rate\": 5}") == http.StatusOK {
+						mutex.Lock()
+						joined[username]++
+						mutex.Unlock()
+					}
+				case 1:
+					driverRequest(changeRate, "PUT", username, fmt.Sprintf("{\"rate\": %d}", i+1))
+				case 2:
+					if driverRequest(leaveRoster, "DELETE", username, "") == http.StatusOK {
+						mutex.Lock()
+						joined[username]--
+						mutex.Unlock()
+					}
+				case 3:
+					driverRequest(getDrivers, "GET", username, "")
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	listed, err := store.List()
+	if err != nil {
+		log.Printf("Failed to list roster after concurrent updates : %s", err)
+		t.FailNow()
+	}
+
+	inRoster := map[string]bool{}
+	for _, d := range listed {
+		inRoster[d.Username] = true
+	}
+
+	for d := 0; d < drivers; d++ {
+		username := fmt.Sprintf("driver%d", d)
+		if (joined[username] == 1) != inRoster[username] || joined[username] < 0 || joined[username] > 1 {
+			log.Printf("Roster lost an update for %s: net joins %d, in roster %t", username, joined[username], inRoster[username])
+			t.Fail()
+		}
+	}
+}
+
+func TestMemoryRosterStoreConcurrency(t *testing.T) {
+	hammerRoster(t, newMemoryRosterStore())
+}
+
+func TestBoltRosterStoreConcurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roster")
+	if err != nil {
+		log.Printf("Failed to create temporary directory : %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newBoltRosterStore(filepath.Join(dir, "roster.db"))
+	if err != nil {
+		log.Printf("Failed to open bolt roster store : %s", err)
+		t.FailNow()
+	}
+	defer store.db.Close()
+
+	hammerRoster(t, store)
+}
+
+func TestBoltRosterStorePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roster")
+	if err != nil {
+		log.Printf("Failed to create temporary directory : %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "roster.db")
+
+	store, _ := newBoltRosterStore(path)
+	store.Join(driver{Username: "sebvet", Name: "Sebastian Vettel", Rate: 5})
+	store.db.Close()
+
+	// Reopening the file is the same as the service restarting
+	store, err = newBoltRosterStore(path)
+	if err != nil {
+		log.Printf("Failed to reopen bolt roster store : %s", err)
+		t.FailNow()
+	}
+	defer store.db.Close()
+
+	d, err := store.Get("sebvet")
+	if err != nil || d.Rate != 5 {
+		log.Println("Failed to keep roster across restart")
+		t.Fail()
+	}
+
+	if err := store.Join(d); err != ErrAlreadyInRoster {
+		log.Println("Failed to reject joining roster twice")
+		t.Fail()
+	}
+}
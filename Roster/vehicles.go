@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const maxSeats = 16
+
+var fuelTypes = map[string]bool{"petrol": true, "diesel": true, "hybrid": true, "electric": true}
+var accessibilityFeatures = map[string]bool{"wheelchair": true, "step_free": true, "hearing_loop": true}
+
+// UK plates are at most seven characters, but cherished and older plates vary, so only the alphabet is checked.
+var registrationPattern = regexp.MustCompile(`^[A-Z0-9]{2,8}$`)
+
+// A car a driver has registered. Drivers choose which one they are driving when they join the roster.
+type vehicle struct {
+	Registration  string   `json:"registration"`
+	Make          string   `json:"make"`
+	Model         string   `json:"model"`
+	Seats         int      `json:"seats"`
+	FuelType      string   `json:"fuel_type"`
+	Accessibility []string `json:"accessibility"`
+}
+
+func (v vehicle) hasFeature(feature string) bool {
+	for _, f := range v.Accessibility {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Plates are written with or without a space and in any case, so they are compared without either.
+func normaliseRegistration(registration string) string {
+	return strings.ToUpper(strings.ReplaceAll(registration, " ", ""))
+}
+
+// Returns a message for the first problem with the vehicle, or "" if it is valid.
+func validateVehicle(v vehicle) string {
+	switch {
+	case !registrationPattern.MatchString(v.Registration):
+		return "Invalid registration supplied"
+	case strings.TrimSpace(v.Make) == "" || strings.TrimSpace(v.Model) == "":
+		return "Make and model are required"
+	case v.Seats < 1 || v.Seats > maxSeats:
+		return "Seats must be between 1 and 16"
+	case !fuelTypes[v.FuelType]:
+		return "Fuel type must be one of petrol, diesel, hybrid or electric"
+	}
+	for _, feature := range v.Accessibility {
+		if !accessibilityFeatures[feature] {
+			return "Accessibility features must be from wheelchair, step_free and hearing_loop"
+		}
+	}
+	return ""
+}
+
+// Requires authentication as a driver. Lists the vehicles they have registered.
+func listVehicles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := authenticatedDriver(r)
+
+	vehicles, err := roster.Vehicles(user.Username)
+
+	if err != nil {
+		log.Printf("Error: Could not read vehicles of user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not read vehicles\"}"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(vehicles)
+}
+
+// Requires authentication as a driver. Registers a vehicle they can then join the roster with.
+func addVehicle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Printf("Error: Parsing request to add vehicle failed : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Parsing request to add vehicle failed\"}"))
+		return
+	}
+
+	var v vehicle
+	if err := json.Unmarshal(body, &v); err != nil {
+		log.Printf("Error: Invalid vehicle supplied : %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Invalid vehicle supplied\"}"))
+		return
+	}
+
+	v.Registration = normaliseRegistration(v.Registration)
+	if v.Accessibility == nil {
+		v.Accessibility = []string{}
+	}
+
+	if problem := validateVehicle(v); problem != "" {
+		log.Printf("Error: Invalid vehicle supplied : %s", problem)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"" + problem + "\"}"))
+		return
+	}
+
+	user := authenticatedDriver(r)
+	err = roster.AddVehicle(user.Username, v)
+
+	if err == ErrVehicleExists {
+		log.Printf("Error: User %s has already registered vehicle %s", user.Username, v.Registration)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("{\"error\": \"Vehicle is already registered\"}"))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not add vehicle for user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not add vehicle\"}"))
+		return
+	}
+
+	log.Printf("User %s registered vehicle %s.", user.Username, v.Registration)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Requires authentication as a driver. The vehicle cannot be removed while the driver is in the roster with it.
+func removeVehicle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user := authenticatedDriver(r)
+	registration := normaliseRegistration(mux.Vars(r)["registration"])
+
+	err := roster.RemoveVehicle(user.Username, registration)
+
+	if err == ErrVehicleNotFound {
+		log.Printf("Error: User %s has no vehicle %s", user.Username, registration)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{\"error\": \"Vehicle not found\"}"))
+		return
+	}
+
+	if err == ErrVehicleInUse {
+		log.Printf("Error: User %s tried to remove vehicle %s while in the roster with it", user.Username, registration)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("{\"error\": \"Leave the roster before removing this vehicle\"}"))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not remove vehicle for user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not remove vehicle\"}"))
+		return
+	}
+
+	log.Printf("User %s removed vehicle %s.", user.Username, registration)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Works out which vehicle a joining driver is using. With no registration given, a driver with exactly
+// one vehicle uses it, and a driver with none joins without one.
+func chooseVehicle(username, registration string) (*vehicle, string, error) {
+	vehicles, err := roster.Vehicles(username)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if registration == "" {
+		switch len(vehicles) {
+		case 0:
+			return nil, "", nil
+		case 1:
+			return &vehicles[0], "", nil
+		default:
+			return nil, "Choose which vehicle to join the roster with", nil
+		}
+	}
+
+	registration = normaliseRegistration(registration)
+	for i := range vehicles {
+		if vehicles[i].Registration == registration {
+			return &vehicles[i], "", nil
+		}
+	}
+	return nil, "Vehicle not found", nil
+}
+
+// Vehicle requirements a rider can ask for, read from the query string.
+type vehicleFilter struct {
+	minSeats      int
+	fuelType      string
+	accessibility []string
+}
+
+func parseVehicleFilter(r *http.Request) (vehicleFilter, string) {
+	query := r.URL.Query()
+	var filter vehicleFilter
+
+	if seats := query.Get("min_seats"); seats != "" {
+		n, err := strconv.Atoi(seats)
+		if err != nil || n < 1 {
+			return filter, "min_seats must be a positive number"
+		}
+		filter.minSeats = n
+	}
+
+	if fuelType := query.Get("fuel_type"); fuelType != "" {
+		if !fuelTypes[fuelType] {
+			return filter, "fuel_type must be one of petrol, diesel, hybrid or electric"
+		}
+		filter.fuelType = fuelType
+	}
+
+	if features := query.Get("accessibility"); features != "" {
+		for _, feature := range strings.Split(features, ",") {
+			if !accessibilityFeatures[feature] {
+				return filter, "accessibility must be from wheelchair, step_free and hearing_loop"
+			}
+			filter.accessibility = append(filter.accessibility, feature)
+		}
+	}
+	return filter, ""
+}
+
+func (f vehicleFilter) empty() bool {
+	return f.minSeats == 0 && f.fuelType == "" && len(f.accessibility) == 0
+}
+
+// Reports whether the driver's vehicle meets every requirement. Drivers without a vehicle only match an empty filter.
+func (f vehicleFilter) matches(d driver) bool {
+	if f.empty() {
+		return true
+	}
+	if d.Vehicle == nil || d.Vehicle.Seats < f.minSeats || (f.fuelType != "" && d.Vehicle.FuelType != f.fuelType) {
+		return false
+	}
+	for _, feature := range f.accessibility {
+		if !d.Vehicle.hasFeature(feature) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVehicleFilter(t *testing.T) {
+	xl := driver{Username: "xl", Vehicle: &vehicle{Seats: 7, FuelType: "diesel", Accessibility: []string{"wheelchair", "step_free"}}}
+	leaf := driver{Username: "leaf", Vehicle: &vehicle{Seats: 4, FuelType: "electric", Accessibility: []string{}}}
+	noVehicle := driver{Username: "walker"}
+
+	cases := []struct {
+		query   string
+		matches string
+	}{
+		{"", "xl leaf walker"},
+		{"min_seats=6", "xl"},
+		{"fuel_type=electric", "leaf"},
+		{"accessibility=wheelchair,step_free", "xl"},
+		{"min_seats=5&fuel_type=electric", ""},
+	}
+
+	for _, c := range cases {
+		filter, problem := parseVehicleFilter(httptest.NewRequest("GET", "/roster?"+c.query, nil))
+		if problem != "" {
+			log.Printf("Failed to parse vehicle filter %q : %s", c.query, problem)
+			t.Fail()
+			continue
+		}
+
+		var matched []string
+		for _, d := range []driver{xl, leaf, noVehicle} {
+			if filter.matches(d) {
+				matched = append(matched, d.Username)
+			}
+		}
+
+		if strings.Join(matched, " ") != c.matches {
+			log.Printf("Failed to filter drivers by %q, got %v", c.query, matched)
+			t.Fail()
+		}
+	}
+
+	if _, problem := parseVehicleFilter(httptest.NewRequest("GET", "/roster?fuel_type=steam", nil)); problem == "" {
+		log.Println("Failed to reject unknown fuel type")
+		t.Fail()
+	}
+}
+
+// A vehicle cannot be removed while its driver is in the roster with it.
+func checkVehicleInUse(t *testing.T, store DriverStore) {
+	leaf := vehicle{Registration: "AB12CDE", Make: "Nissan", Model: "Leaf", Seats: 4, FuelType: "electric"}
+	spare := vehicle{Registration: "XY21ZZZ", Make: "Ford", Model: "Galaxy", Seats: 7, FuelType: "diesel"}
+
+	store.AddVehicle("sebvet", leaf)
+	store.AddVehicle("sebvet", spare)
+
+	if err := store.AddVehicle("sebvet", leaf); err != ErrVehicleExists {
+		log.Println("Failed to refuse registering a vehicle twice")
+		t.Fail()
+	}
+
+	store.Join(driver{Username: "sebvet", Rate: 5, State: stateAvailable, Vehicle: &leaf})
+
+	if err := store.RemoveVehicle("sebvet", leaf.Registration); err != ErrVehicleInUse {
+		log.Println("Failed to refuse removing vehicle in use")
+		t.Fail()
+	}
+
+	if err := store.RemoveVehicle("sebvet", spare.Registration); err != nil {
+		log.Printf("Failed to remove spare vehicle : %s", err)
+		t.Fail()
+	}
+
+	if vehicles, _ := store.Vehicles("sebvet"); len(vehicles) != 1 || vehicles[0].Registration != leaf.Registration {
+		log.Printf("Failed to keep vehicle in use, got %v", vehicles)
+		t.Fail()
+	}
+
+	store.Leave("sebvet")
+
+	if err := store.RemoveVehicle("sebvet", leaf.Registration); err != nil {
+		log.Printf("Failed to remove vehicle after leaving roster : %s", err)
+		t.Fail()
+	}
+}
+
+func TestMemoryRosterStoreVehicles(t *testing.T) {
+	checkVehicleInUse(t, newMemoryRosterStore())
+}
+
+func TestBoltRosterStoreVehicles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roster")
+	if err != nil {
+		log.Printf("Failed to create temporary directory : %s", err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newBoltRosterStore(filepath.Join(dir, "roster.db"))
+	if err != nil {
+		log.Printf("Failed to open bolt roster store : %s", err)
+		t.FailNow()
+	}
+	defer store.db.Close()
+
+	checkVehicleInUse(t, store)
+}
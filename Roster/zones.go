@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Areas and zones are kept small so that checking every driver against a pickup stays quick.
+const maxAreaPositions = 5000
+const maxAreaDistricts = 200
+const maxDriverZones = 20
+
+var districtPattern = regexp.MustCompile(`^[A-Z]{1,2}[0-9][A-Z0-9]?$`)
+var inwardCodePattern = regexp.MustCompile(`[0-9][A-Z]{2}$`)
+var zoneIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// A GeoJSON Polygon or MultiPolygon. Positions are [longitude, latitude], as GeoJSON has them.
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// Where a driver works, or a city zone covers. Either part may be left out.
+type operatingArea struct {
+	Geometry *geoJSONGeometry `json:"geometry,omitempty"`
+	// Postcode districts, the part of a postcode before the space, such as "EX4".
+	Districts []string `json:"districts,omitempty"`
+}
+
+// A driver's area can also take in city zones by id.
+type driverArea struct {
+	operatingArea
+	Zones []string `json:"zones,omitempty"`
+}
+
+// An area defined by an admin, such as a city, that drivers can work in.
+type cityZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	operatingArea
+}
+
+// Where a journey starts. Either part may be missing.
+type pickup struct {
+	hasPoint bool
+	lat, lng float64
+	district string
+}
+
+type polygon [][][2]float64
+
+// Parses the geometry into polygons, each an outer ring followed by any holes.
+func (g geoJSONGeometry) polygons() ([]polygon, error) {
+	switch g.Type {
+	case "Polygon":
+		var p polygon
+		if err := json.Unmarshal(g.Coordinates, &p); err != nil {
+			return nil, err
+		}
+		return []polygon{p}, nil
+	case "MultiPolygon":
+		var ps []polygon
+		err := json.Unmarshal(g.Coordinates, &ps)
+		return ps, err
+	default:
+		return nil, errors.New("geometry must be a Polygon or MultiPolygon")
+	}
+}
+
+// Reports whether the point is inside the ring, by counting how many of its edges a line east from the point crosses.
+func ringContains(ring [][2]float64, lat, lng float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		lngI, latI := ring[i][0], ring[i][1]
+		lngJ, latJ := ring[j][0], ring[j][1]
+		if (latI > lat) != (latJ > lat) && lng < (lngJ-lngI)*(lat-latI)/(latJ-latI)+lngI {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (p polygon) contains(lat, lng float64) bool {
+	if len(p) == 0 || !ringContains(p[0], lat, lng) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if ringContains(hole, lat, lng) {
+			return false
+		}
+	}
+	return true
+}
+
+// Normalises a postcode district, or a full postcode to its district, e.g. "ex4 4qj" to "EX4".
+// Returns "" if it is not a postcode.
+func postcodeDistrict(postcode string) string {
+	code := strings.ToUpper(strings.Join(strings.Fields(postcode), ""))
+	if len(code) >= 5 && inwardCodePattern.MatchString(code) && districtPattern.MatchString(code[:len(code)-3]) {
+		return code[:len(code)-3]
+	}
+	if districtPattern.MatchString(code) {
+		return code
+	}
+	return ""
+}
+
+// Returns a message for the first problem with the area, or "" if it is valid. Districts are normalised in place.
+func validateArea(a *operatingArea) string {
+	if a.Geometry != nil {
+		polygons, err := a.Geometry.polygons()
+		if err != nil || len(polygons) == 0 {
+			return "Geometry must be a GeoJSON Polygon or MultiPolygon"
+		}
+
+		positions := 0
+		for _, p := range polygons {
+			if len(p) == 0 {
+				return "Polygons need at least one ring"
+			}
+			for _, ring := range p {
+				if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+					return "Polygon rings need at least four positions, with the last the same as the first"
+				}
+				for _, position := range ring {
+					if position[0] < -180 || position[0] > 180 || position[1] < -90 || position[1] > 90 {
+						return "Positions must be [longitude, latitude]"
+					}
+				}
+				positions += len(ring)
+			}
+		}
+		if positions > maxAreaPositions {
+			return "Areas can have at most 5000 positions"
+		}
+	}
+
+	if len(a.Districts) > maxAreaDistricts {
+		return "Areas can have at most 200 postcode districts"
+	}
+	for i, district := range a.Districts {
+		normalised := strings.ToUpper(strings.TrimSpace(district))
+		if !districtPattern.MatchString(normalised) {
+			return "Invalid postcode district " + district
+		}
+		a.Districts[i] = normalised
+	}
+	return ""
+}
+
+// Reports whether the area could be checked against the pickup, and if so whether it covers it.
+// A pickup given only as a postcode cannot be checked against a polygon, and a point cannot be checked against districts.
+func (a operatingArea) covers(p pickup) (checked, covered bool) {
+	if p.hasPoint && a.Geometry != nil {
+		checked = true
+		polygons, _ := a.Geometry.polygons()
+		for _, polygon := range polygons {
+			if polygon.contains(p.lat, p.lng) {
+				return true, true
+			}
+		}
+	}
+
+	if p.district != "" && len(a.Districts) > 0 {
+		checked = true
+		for _, district := range a.Districts {
+			if district == p.district {
+				return true, true
+			}
+		}
+	}
+	return checked, false
+}
+
+// Reports whether the driver works where the pickup is. Drivers are only left out when their area could be
+// checked against the pickup and does not cover it, so drivers who have not set an area are never left out.
+// A zone that has since been deleted covers nowhere, so a driver whose area was only that zone is left out
+// everywhere until they set their area again.
+func (p pickup) servedBy(username string) (bool, error) {
+	area, err := roster.Area(username)
+	if err != nil {
+		return false, err
+	}
+
+	checked, covered := area.covers(p)
+	if covered {
+		return true, nil
+	}
+
+	for _, id := range area.Zones {
+		zone, err := roster.Zone(id)
+		if err == ErrZoneNotFound {
+			checked = true
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		zoneChecked, zoneCovered := zone.covers(p)
+		if zoneCovered {
+			return true, nil
+		}
+		checked = checked || zoneChecked
+	}
+	return !checked, nil
+}
+
+// Leaves out the drivers who do not work where the pickup is.
+func (p pickup) filter(drivers []driver) ([]driver, error) {
+	served := []driver{}
+	for _, d := range drivers {
+		ok, err := p.servedBy(d.Username)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			served = append(served, d)
+		}
+	}
+	return served, nil
+}
+
+func (p pickup) given() bool {
+	return p.hasPoint || p.district != ""
+}
+
+// Reads a pickup from the query parameters named prefix+"lat", prefix+"lng" and prefix+"postcode".
+// Returns a message if they are invalid.
+func parsePickup(r *http.Request, prefix string) (pickup, string) {
+	var p pickup
+
+	lat, latErr := queryFloat(r, prefix+"lat", math.NaN())
+	lng, lngErr := queryFloat(r, prefix+"lng", math.NaN())
+	if latErr != nil || lngErr != nil || math.IsNaN(lat) != math.IsNaN(lng) {
+		return p, "A valid lat and lng are required"
+	}
+	if !math.IsNaN(lat) {
+		if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+			return p, "A valid lat and lng are required"
+		}
+		p.hasPoint, p.lat, p.lng = true, lat, lng
+	}
+
+	if postcode := r.URL.Query().Get(prefix + "postcode"); postcode != "" {
+		p.district = postcodeDistrict(postcode)
+		if p.district == "" {
+			return p, "Invalid postcode"
+		}
+	}
+	return p, ""
+}
+
+// Requires authentication as a driver. Returns the area the driver works in, which is empty if they have not set one.
+func getArea(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	user := authenticatedDriver(r)
+
+	area, err := roster.Area(user.Username)
+
+	if err != nil {
+		log.Printf("Error: Could not read operating area of user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not read operating area\"}"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(area)
+}
+
+// Requires authentication as a driver. Replaces the area the driver works in. Sending an empty area
+// means the driver works anywhere.
+func setArea(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Printf("Error: Parsing request to set operating area failed : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Parsing request to set operating area failed\"}"))
+		return
+	}
+
+	var area driverArea
+	if err := json.Unmarshal(body, &area); err != nil {
+		log.Printf("Error: Invalid operating area supplied : %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Invalid operating area supplied\"}"))
+		return
+	}
+
+	problem := validateArea(&area.operatingArea)
+	if problem == "" && len(area.Zones) > maxDriverZones {
+		problem = "Drivers can work in at most 20 zones"
+	}
+	for _, id := range area.Zones {
+		if problem != "" {
+			break
+		}
+		if _, err := roster.Zone(id); err == ErrZoneNotFound {
+			problem = "Unknown zone " + id
+		} else if err != nil {
+			log.Printf("Error: Could not read zone %s : %s", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("{\"error\": \"Could not read zones\"}"))
+			return
+		}
+	}
+
+	if problem != "" {
+		log.Printf("Error: Invalid operating area supplied : %s", problem)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"" + problem + "\"}"))
+		return
+	}
+
+	user := authenticatedDriver(r)
+
+	if err := roster.SetArea(user.Username, area); err != nil {
+		log.Printf("Error: Could not save operating area of user %s : %s", user.Username, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not save operating area\"}"))
+		return
+	}
+
+	log.Printf("Operating area updated for user %s.", user.Username)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(area)
+}
+
+// Requires authentication as a driver or admin. Lists the city zones, ordered by id.
+func listZones(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	zones, err := roster.Zones()
+
+	if err != nil {
+		log.Printf("Error: Could not read zones : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not read zones\"}"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(zones)
+}
+
+// Requires authentication as an admin. Creates or replaces a city zone.
+func putZone(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id := mux.Vars(r)["id"]
+
+	if !zoneIDPattern.MatchString(id) {
+		log.Printf("Error: Invalid zone id %s", id)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Zone ids are lower case letters, digits and dashes\"}"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Printf("Error: Parsing request to save zone failed : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Parsing request to save zone failed\"}"))
+		return
+	}
+
+	var zone cityZone
+	if err := json.Unmarshal(body, &zone); err != nil {
+		log.Printf("Error: Invalid zone supplied : %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"Invalid zone supplied\"}"))
+		return
+	}
+	zone.ID = id
+
+	problem := validateArea(&zone.operatingArea)
+	if problem == "" && zone.Name == "" {
+		problem = "Zones need a name"
+	}
+	if problem == "" && zone.Geometry == nil && len(zone.Districts) == 0 {
+		problem = "Zones need a geometry or postcode districts"
+	}
+
+	if problem != "" {
+		log.Printf("Error: Invalid zone supplied : %s", problem)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"" + problem + "\"}"))
+		return
+	}
+
+	if err := roster.PutZone(zone); err != nil {
+		log.Printf("Error: Could not save zone %s : %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not save zone\"}"))
+		return
+	}
+
+	log.Printf("Zone %s saved.", id)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(zone)
+}
+
+// Requires authentication as an admin. Deletes a city zone. Drivers who worked in it no longer do, see servedBy.
+func deleteZone(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id := mux.Vars(r)["id"]
+	err := roster.DeleteZone(id)
+
+	if err == ErrZoneNotFound {
+		log.Printf("Error: Zone %s not found", id)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{\"error\": \"Zone not found\"}"))
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error: Could not delete zone %s : %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not delete zone\"}"))
+		return
+	}
+
+	log.Printf("Zone %s deleted.", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Requires a service token with the roster:read scope.
+// Lists the city zones that take in a point given by lat and lng, or a postcode.
+func matchZones(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	p, problem := parsePickup(r, "")
+	if problem == "" && !p.given() {
+		problem = "A lat and lng or a postcode is required"
+	}
+
+	if problem != "" {
+		log.Printf("Error: Invalid zone query : %s", problem)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"error\": \"" + problem + "\"}"))
+		return
+	}
+
+	zones, err := roster.Zones()
+
+	if err != nil {
+		log.Printf("Error: Could not read zones : %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"error\": \"Could not read zones\"}"))
+		return
+	}
+
+	matches := []cityZone{}
+	for _, zone := range zones {
+		if _, covered := zone.covers(p); covered {
+			matches = append(matches, zone)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(matches)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+// Roughly Exeter city centre, with Exeter Cathedral Green cut out.
+const exeterGeometry = `{"type": "Polygon", "coordinates": [
+	[[-3.56, 50.70], [-3.50, 50.70], [-3.50, 50.74], [-3.56, 50.74], [-3.56, 50.70]],
+	[[-3.532, 50.721], [-3.529, 50.721], [-3.529, 50.723], [-3.532, 50.723], [-3.532, 50.721]]
+]}`
+
+func mustGeometry(t *testing.T, data string) *geoJSONGeometry {
+	var g geoJSONGeometry
+	if err := json.Unmarshal([]byte(data), &g); err != nil {
+		log.Printf("Failed to parse geometry : %s", err)
+		t.FailNow()
+	}
+	return &g
+}
+
+func TestPostcodeDistrict(t *testing.T) {
+	cases := map[string]string{
+		"EX4 4QJ":  "EX4",
+		"ex44qj":   "EX4",
+		"SW1A 1AA": "SW1A",
+		"M1 1AE":   "M1",
+		"ex4":      "EX4",
+		"Exeter":   "",
+		"":         "",
+	}
+
+	for postcode, district := range cases {
+		if got := postcodeDistrict(postcode); got != district {
+			log.Printf("Failed to find district of %q, got %q not %q", postcode, got, district)
+			t.Fail()
+		}
+	}
+}
+
+func TestAreaCovers(t *testing.T) {
+	area := operatingArea{Geometry: mustGeometry(t, exeterGeometry)}
+	if problem := validateArea(&area); problem != "" {
+		log.Printf("Failed to validate area : %s", problem)
+		t.FailNow()
+	}
+
+	cases := []struct {
+		name    string
+		pickup  pickup
+		covered bool
+	}{
+		{"Exeter St Davids", pickup{hasPoint: true, lat: 50.7292, lng: -3.5435}, true},
+		{"Cathedral Green", pickup{hasPoint: true, lat: 50.722, lng: -3.530}, false},
+		{"Crediton", pickup{hasPoint: true, lat: 50.7916, lng: -3.6554}, false},
+	}
+
+	for _, c := range cases {
+		if _, covered := area.covers(c.pickup); covered != c.covered {
+			log.Printf("Failed to check whether area covers %s", c.name)
+			t.Fail()
+		}
+	}
+
+	if problem := validateArea(&operatingArea{Geometry: mustGeometry(t, `{"type": "Polygon", "coordinates": [[[-3.56, 50.70], [-3.50, 50.70], [-3.50, 50.74]]]}`)}); problem == "" {
+		log.Println("Failed to reject ring that is not closed")
+		t.Fail()
+	}
+
+	if problem := validateArea(&operatingArea{Districts: []string{"Exeter"}}); problem == "" {
+		log.Println("Failed to reject invalid postcode district")
+		t.Fail()
+	}
+}
+
+func TestPickupServedBy(t *testing.T) {
+	roster = newMemoryRosterStore()
+
+	roster.PutZone(cityZone{ID: "exeter", Name: "Exeter", operatingArea: operatingArea{Geometry: mustGeometry(t, exeterGeometry)}})
+	roster.SetArea("sebvet", driverArea{Zones: []string{"exeter"}})
+	roster.SetArea("babydriver", driverArea{operatingArea: operatingArea{Districts: []string{"EX17"}}})
+	// walker has not set an area
+
+	drivers := []driver{{Username: "babydriver"}, {Username: "sebvet"}, {Username: "walker"}}
+
+	cases := []struct {
+		name   string
+		pickup pickup
+		served string
+	}{
+		// babydriver's districts cannot be checked against a point, so they are kept
+		{"Exeter St Davids", pickup{hasPoint: true, lat: 50.7292, lng: -3.5435}, "babydriver sebvet walker"},
+		{"Crediton", pickup{hasPoint: true, lat: 50.7916, lng: -3.6554, district: "EX17"}, "babydriver walker"},
+		{"Exeter postcode", pickup{district: "EX4"}, "sebvet walker"},
+	}
+
+	for _, c := range cases {
+		served, err := c.pickup.filter(drivers)
+		if err != nil {
+			log.Printf("Failed to filter drivers by pickup : %s", err)
+			t.FailNow()
+		}
+
+		var names []string
+		for _, d := range served {
+			names = append(names, d.Username)
+		}
+
+		if strings.Join(names, " ") != c.served {
+			log.Printf("Failed to filter drivers by pickup at %s, got %v", c.name, names)
+			t.Fail()
+		}
+	}
+
+	// Drivers stop working in a zone once it is deleted, but are not then taken to work everywhere
+	roster.SetArea("walker", driverArea{operatingArea: operatingArea{Districts: []string{"EX4"}}, Zones: []string{"exeter"}})
+	roster.DeleteZone("exeter")
+
+	for _, p := range []pickup{{hasPoint: true, lat: 50.7292, lng: -3.5435}, {district: "EX4"}, {district: "TQ1"}} {
+		if served, _ := p.servedBy("sebvet"); served {
+			log.Printf("Failed to leave out driver whose only zone was deleted, at %v", p)
+			t.Fail()
+		}
+	}
+
+	if served, _ := (pickup{district: "EX4"}).servedBy("walker"); !served {
+		log.Println("Failed to keep districts of driver whose zone was deleted")
+		t.Fail()
+	}
+
+	if served, _ := (pickup{district: "EX17"}).servedBy("walker"); served {
+		log.Println("Failed to leave out driver outside the rest of their area after zone was deleted")
+		t.Fail()
+	}
+}
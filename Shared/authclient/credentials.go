@@ -0,0 +1,111 @@
+package authclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Internal address of Auth's token endpoint.
+const DefaultTokenURL = "http://auth-service:8000/oauth/token"
+
+// Tokens are renewed this long before they expire, so that a token never expires in flight.
+const tokenExpiryMargin = 30 * time.Second
+
+// ClientCredentials fetches service tokens from Auth with the OAuth2 client-credentials grant
+// and caches them until shortly before they expire. It is safe for concurrent use.
+type ClientCredentials struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	client       *http.Client
+
+	mutex     sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func NewClientCredentials(tokenURL, clientID, clientSecret string, scopes ...string) *ClientCredentials {
+	return &ClientCredentials{
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       scopes,
+		client:       &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Token returns a valid service token, fetching a new one if the cached token is about to expire.
+func (c *ClientCredentials) Token() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.token != "" && time.Now().Add(tokenExpiryMargin).Before(c.expiresAt) {
+		return c.token, nil
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+	if len(c.scopes) > 0 {
+		data.Set("scope", strings.Join(c.scopes, " "))
+	}
+
+	req, err := http.NewRequest("POST", c.tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.clientID, c.clientSecret)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching service token from %s returned %s", c.tokenURL, resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	c.token = body.AccessToken
+	c.expiresAt = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// Client returns an HTTP client that sends a service token with every request.
+func (c *ClientCredentials) Client() *http.Client {
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &bearerTransport{credentials: c, base: http.DefaultTransport},
+	}
+}
+
+type bearerTransport struct {
+	credentials *ClientCredentials
+	base        http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token, err := t.credentials.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers must not modify the caller's request
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,108 @@
+package authclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var ErrNoToken = errors.New("no bearer token in request")
+
+// Sent with responses to requests that authenticated with the deprecated body token.
+const bodyTokenWarning = `299 - "Sending the JWT in the request body is deprecated. Use an Authorization: Bearer header instead."`
+
+// BearerToken is a TokenExtractor that reads an "Authorization: Bearer" header.
+func BearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", ErrNoToken
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")), nil
+}
+
+// WebSocket subprotocol that a client offers, followed by its token, to authenticate without a header,
+// as in "Sec-WebSocket-Protocol: bearer, <token>". Servers must accept it so that the handshake succeeds.
+const BearerProtocol = "bearer"
+
+// StreamToken is a TokenExtractor for streams that browsers open with EventSource or WebSocket, neither of which
+// can set an Authorization header. It prefers the header. A WebSocket handshake may instead offer the token as
+// the subprotocol after BearerProtocol. Only a Server-Sent Events request, which asks for text/event-stream,
+// may send it in the access_token query parameter, since EventSource has no other way to. URLs end up in
+// access logs, so nothing else is read from the query, and only short-lived access tokens should be sent there.
+func StreamToken(r *http.Request) (string, error) {
+	if raw, err := BearerToken(r); err == nil {
+		return raw, nil
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		var protocols []string
+		for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+			for _, protocol := range strings.Split(header, ",") {
+				protocols = append(protocols, strings.TrimSpace(protocol))
+			}
+		}
+		for i := 0; i+1 < len(protocols); i++ {
+			if protocols[i] == BearerProtocol && protocols[i+1] != "" {
+				return protocols[i+1], nil
+			}
+		}
+		return "", ErrNoToken
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		if raw := r.URL.Query().Get("access_token"); raw != "" {
+			return raw, nil
+		}
+	}
+	return "", ErrNoToken
+}
+
+// BodyToken is a TokenExtractor that reads the "token" field of a JSON body, then restores the body
+// for the handler. This is how clients authenticated before the Authorization header was supported.
+func BodyToken(r *http.Request) (string, error) {
+	if r.Body == nil {
+		return "", ErrNoToken
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var requestData struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &requestData); err != nil || requestData.Token == "" {
+		return "", ErrNoToken
+	}
+	return requestData.Token, nil
+}
+
+// BearerOrBodyToken is a TokenExtractor that prefers the Authorization header, falling back to the body token.
+// Use it with DeprecateBodyToken so that clients still sending the body token are warned.
+func BearerOrBodyToken(r *http.Request) (string, error) {
+	if raw, err := BearerToken(r); err == nil {
+		return raw, nil
+	}
+	return BodyToken(r)
+}
+
+// DeprecateBodyToken is middleware that adds Deprecation and Warning headers to responses to requests
+// that carry their JWT in the body rather than the Authorization header.
+func DeprecateBodyToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := BearerToken(r); err != nil {
+			if _, err := BodyToken(r); err == nil {
+				log.Printf("Warning: Deprecated body token used for %s %s", r.Method, r.URL.Path)
+				w.Header().Set("Deprecation", "true")
+				w.Header().Set("Warning", bodyTokenWarning)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,125 @@
+package authclient
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Roles that can appear in the roles claim.
+const (
+	RoleRider  = "rider"
+	RoleDriver = "driver"
+	RoleAdmin  = "admin"
+)
+
+// TokenVerifier turns a raw JWT into its claims. *Verifier is the usual implementation,
+// but the Auth service supplies its own so that revoked tokens are also rejected.
+type TokenVerifier interface {
+	Verify(raw string) (*Claims, error)
+}
+
+// TokenExtractor finds the raw JWT in a request. See extract.go for the usual ones.
+type TokenExtractor func(r *http.Request) (string, error)
+
+type contextKey int
+
+const claimsKey contextKey = 0
+
+// WithClaims returns a copy of ctx carrying the authenticated caller's claims.
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFromContext returns the claims stored by the middleware, if any.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*Claims)
+	return claims, ok
+}
+
+// HasRole reports whether the token was issued with the given role.
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the token was issued with the given scope.
+func (c *Claims) HasScope(scope string) bool {
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal names the user or service the token was issued to, for logging.
+func (c *Claims) Principal() string {
+	if c.ClientID != "" {
+		return "client " + c.ClientID
+	}
+	return "user " + c.Username
+}
+
+// Builds middleware that verifies the request's token and then asks allowed whether the caller may continue.
+// Requests without a valid token get 401 and requests that are not allowed get 403.
+func require(verifier TokenVerifier, extract TokenExtractor, allowed func(*Claims) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			raw, err := extract(r)
+			var claims *Claims
+			if err == nil {
+				claims, err = verifier.Verify(raw)
+			}
+
+			if err != nil {
+				log.Printf("Error: Invalid JWT token: %s", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("{\"error\": \"Invalid JWT token\"}"))
+				return
+			}
+
+			if !allowed(claims) {
+				log.Printf("Error: %s lacks the permission needed for %s %s", claims.Principal(), r.Method, r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("{\"error\": \"Insufficient permissions\"}"))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+		})
+	}
+}
+
+// RequireRole returns middleware that only lets through requests carrying a valid user token with at least one of roles.
+// Requests without a valid token get 401 and requests without a required role get 403.
+// The caller's claims are stored in the request context for the wrapped handler.
+func RequireRole(verifier TokenVerifier, extract TokenExtractor, roles ...string) func(http.Handler) http.Handler {
+	return require(verifier, extract, func(claims *Claims) bool {
+		for _, role := range roles {
+			if claims.HasRole(role) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RequireScope is like RequireRole, but for service tokens. Requests must carry a token with at least one of scopes.
+func RequireScope(verifier TokenVerifier, extract TokenExtractor, scopes ...string) func(http.Handler) http.Handler {
+	return require(verifier, extract, func(claims *Claims) bool {
+		for _, scope := range scopes {
+			if claims.HasScope(scope) {
+				return true
+			}
+		}
+		return false
+	})
+}
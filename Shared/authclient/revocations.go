@@ -0,0 +1,138 @@
+package authclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Internal address of Auth's revocation feed.
+const DefaultRevocationsURL = "http://auth-service:8000/revocations"
+
+// Revocations keeps a copy of Auth's revocation feed, which lists users whose tokens were all revoked at once,
+// for example because they were suspended or deleted, tokens revoked on logout and sessions that have ended.
+// Signatures alone cannot show this, so services that verify tokens locally poll the feed.
+// It is safe for concurrent use.
+type Revocations struct {
+	feedURL string
+	// Must send a service token with the auth:revocations scope, e.g. from ClientCredentials.Client.
+	client *http.Client
+
+	mutex sync.RWMutex
+	// Tokens issued to the user before or during this Unix second are revoked.
+	notBefore map[string]int64
+	// The jti of each revoked token, and the sid of each ended session.
+	tokens   map[string]bool
+	sessions map[string]bool
+}
+
+func NewRevocations(feedURL string, client *http.Client) *Revocations {
+	return &Revocations{
+		feedURL:   feedURL,
+		client:    client,
+		notBefore: map[string]int64{},
+		tokens:    map[string]bool{},
+		sessions:  map[string]bool{},
+	}
+}
+
+// IsRevoked reports whether the token was issued to a user before their tokens were revoked,
+// was itself revoked, or belongs to a session that has ended. iat only has whole seconds, so a token
+// issued in the same second as the revocation counts as issued before it. Auth waits out that second
+// before issuing the user a new token.
+func (r *Revocations) IsRevoked(claims *Claims) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if notBefore, ok := r.notBefore[claims.Username]; ok && claims.IssuedAt <= notBefore {
+		return true
+	}
+	if claims.Id != "" && r.tokens[claims.Id] {
+		return true
+	}
+	return claims.SessionID != "" && r.sessions[claims.SessionID]
+}
+
+// RevokedSince reports whether all of the user's tokens have been revoked after t, for example because they
+// were suspended or deleted. Auth only lists a user until the tokens issued before their revocation have
+// expired, so callers that keep something the user did before t must check at least that often.
+func (r *Revocations) RevokedSince(username string, t time.Time) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	notBefore, ok := r.notBefore[username]
+	return ok && t.Unix() <= notBefore
+}
+
+// Refresh fetches the feed and replaces the local copy.
+func (r *Revocations) Refresh() error {
+	resp, err := r.client.Get(r.feedURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s returned %s", r.feedURL, resp.Status)
+	}
+
+	type revokedID struct {
+		ID string `json:"id"`
+	}
+	var feed struct {
+		Users []struct {
+			Username  string `json:"username"`
+			NotBefore int64  `json:"not_before"`
+		} `json:"users"`
+		Tokens   []revokedID `json:"tokens"`
+		Sessions []revokedID `json:"sessions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return err
+	}
+
+	notBefore := map[string]int64{}
+	for _, user := range feed.Users {
+		notBefore[user.Username] = user.NotBefore
+	}
+
+	tokens := map[string]bool{}
+	for _, token := range feed.Tokens {
+		tokens[token.ID] = true
+	}
+	sessions := map[string]bool{}
+	for _, session := range feed.Sessions {
+		sessions[session.ID] = true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.notBefore = notBefore
+	r.tokens = tokens
+	r.sessions = sessions
+	return nil
+}
+
+// PollEvery refreshes the feed every interval, forever. On failure the last copy is kept. Only the first of
+// a run of failures is logged, since the feed may be polled every second.
+func (r *Revocations) PollEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		if err := r.Refresh(); err != nil {
+			if !failing {
+				log.Printf("Error: Could not refresh revocations, keeping the last copy : %s", err)
+			}
+			failing = true
+		} else if failing {
+			log.Println("Revocations refreshed again.")
+			failing = false
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,183 @@
+// Package authclient lets services check JWTs issued by the Auth service without calling it on every request.
+// Tokens are verified locally against the public keys Auth publishes at /.well-known/jwks.json.
+package authclient
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Internal address of Auth's key set.
+const DefaultJWKSURL = "http://auth-service:8000/.well-known/jwks.json"
+
+// Claims carried by JWTs issued by the Auth service.
+// User tokens carry a username and roles. Service tokens carry a client id and scopes instead.
+type Claims struct {
+	Username string   `json:"username"`
+	Name     string   `json:"name"`
+	Roles    []string `json:"roles,omitempty"`
+	// Space separated, as in OAuth2.
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	// Identifies the sign-in the token was issued under, so that it can be ended from another device.
+	SessionID string `json:"sid,omitempty"`
+	jwt.StandardClaims
+}
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Verifier checks RS256 JWTs against a cached copy of Auth's key set.
+// It is safe for concurrent use.
+type Verifier struct {
+	jwksURL string
+	client  *http.Client
+
+	// How long a fetched key set is trusted before it is fetched again.
+	cacheTTL time.Duration
+	// Minimum time between fetches, so that tokens with unknown kids cannot hammer Auth.
+	minRefreshInterval time.Duration
+
+	// Optional. Tokens revoked by Auth are rejected once the feed has been polled.
+	revocations *Revocations
+
+	mutex       sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+func NewVerifier(jwksURL string) *Verifier {
+	return &Verifier{
+		jwksURL:            jwksURL,
+		client:             &http.Client{Timeout: 5 * time.Second},
+		cacheTTL:           10 * time.Minute,
+		minRefreshInterval: 30 * time.Second,
+		keys:               map[string]*rsa.PublicKey{},
+	}
+}
+
+// CheckRevocations makes Verify also reject tokens listed in Auth's revocation feed.
+// It must be called before the verifier is used.
+func (v *Verifier) CheckRevocations(revocations *Revocations) {
+	v.revocations = revocations
+}
+
+// Verify checks the signature and expiry of raw and returns its claims.
+func (v *Verifier) Verify(raw string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(raw, &Claims{}, v.keyFor)
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	claims := token.Claims.(*Claims)
+	if v.revocations != nil && v.revocations.IsRevoked(claims) {
+		return nil, fmt.Errorf("%w: token of %s has been revoked", ErrInvalidToken, claims.Username)
+	}
+	return claims, nil
+}
+
+// Key function for jwt.Parse. The key set is re-fetched when it is stale or does not know the token's kid,
+// which is how keys rotated in by Auth are picked up.
+func (v *Verifier) keyFor(token *jwt.Token) (interface{}, error) {
+	if token.Method != jwt.SigningMethodRS256 {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	v.mutex.RLock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.fetchedAt) > v.cacheTTL
+	v.mutex.RUnlock()
+
+	if ok && !stale {
+		return key, nil
+	}
+
+	if err := v.refresh(); err != nil && !ok {
+		return nil, err
+	}
+
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+type jsonWebKey struct {
+	KeyType  string `json:"kty"`
+	KeyID    string `json:"kid"`
+	Modulus  string `json:"n"`
+	Exponent string `json:"e"`
+}
+
+// Fetches the key set from Auth, unless it was fetched very recently.
+func (v *Verifier) refresh() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if time.Since(v.attemptedAt) < v.minRefreshInterval {
+		return nil
+	}
+	v.attemptedAt = time.Now()
+
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s returned %s", v.jwksURL, resp.Status)
+	}
+
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range keySet.Keys {
+		if jwk.KeyType != "RSA" {
+			continue
+		}
+		key, err := decodeRSAKey(jwk)
+		if err != nil {
+			return fmt.Errorf("key %s : %s", jwk.KeyID, err)
+		}
+		keys[jwk.KeyID] = key
+	}
+
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	return nil
+}
+
+func decodeRSAKey(jwk jsonWebKey) (*rsa.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(jwk.Modulus)
+	if err != nil {
+		return nil, err
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(jwk.Exponent)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}, nil
+}
@@ -0,0 +1,21 @@
+// Package ukclock holds the UK time zone, for times that services set by the wall clock in the UK,
+// such as rate profiles in Roster and the night surcharge in Journey.
+package ukclock
+
+import (
+	"time"
+
+	// Embedded so that UK local time works even where the host has no zoneinfo
+	_ "time/tzdata"
+)
+
+// Location is Europe/London, so that times follow the switch between GMT and BST.
+var Location = mustLoadLocation("Europe/London")
+
+func mustLoadLocation(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return location
+}